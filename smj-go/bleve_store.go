@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
 	bleveQuery "github.com/blevesearch/bleve/v2/search/query"
@@ -11,6 +15,10 @@ import (
 
 type BleveStore struct {
 	index bleve.Index
+
+	// libIndex holds Library registrations in their own small index,
+	// since Bleve has no separate "table" concept the way SQLite/Postgres do.
+	libIndex bleve.Index
 }
 
 func (b *BleveStore) Initialize(path string) error {
@@ -19,7 +27,7 @@ func (b *BleveStore) Initialize(path string) error {
 	if filepath.Ext(path) == ".sqlite" {
 		path = strings.TrimSuffix(path, ".sqlite") + ".bleve"
 	}
-	
+
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		mapping := bleve.NewIndexMapping()
 		index, err := bleve.New(path, mapping)
@@ -34,16 +42,231 @@ func (b *BleveStore) Initialize(path string) error {
 		}
 		b.index = index
 	}
+
+	libPath := strings.TrimSuffix(path, ".bleve") + ".libraries.bleve"
+	if _, err := os.Stat(libPath); os.IsNotExist(err) {
+		libIndex, err := bleve.New(libPath, bleve.NewIndexMapping())
+		if err != nil {
+			return err
+		}
+		b.libIndex = libIndex
+	} else {
+		libIndex, err := bleve.Open(libPath)
+		if err != nil {
+			return err
+		}
+		b.libIndex = libIndex
+	}
 	return nil
 }
 
 func (b *BleveStore) Close() error {
+	if b.libIndex != nil {
+		b.libIndex.Close()
+	}
 	if b.index != nil {
 		return b.index.Close()
 	}
 	return nil
 }
 
+// libraryDocID is the Bleve document id a Library is stored under in libIndex.
+func libraryDocID(id int64) string {
+	return fmt.Sprintf("lib:%d", id)
+}
+
+func (b *BleveStore) AddLibrary(name, path string) (int64, error) {
+	libs, err := b.ListLibraries()
+	if err != nil {
+		return 0, err
+	}
+	var id int64 = 1
+	for _, l := range libs {
+		if l.ID >= id {
+			id = l.ID + 1
+		}
+	}
+	if err := b.libIndex.Index(libraryDocID(id), Library{ID: id, Name: name, Path: path}); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (b *BleveStore) RemoveLibrary(id int64) error {
+	if err := b.libIndex.Delete(libraryDocID(id)); err != nil {
+		return err
+	}
+	batch := b.index.NewBatch()
+	paths, err := b.GetAllPaths(id)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		batch.Delete(path)
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *BleveStore) ListLibraries() ([]Library, error) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = 10000
+	req.Fields = []string{"*"}
+
+	res, err := b.libIndex.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var libs []Library
+	for _, hit := range res.Hits {
+		// libIndex also holds users, settings and pending listens.
+		if !strings.HasPrefix(hit.ID, "lib:") {
+			continue
+		}
+		var l Library
+		if v, ok := hit.Fields["id"].(float64); ok {
+			l.ID = int64(v)
+		}
+		if v, ok := hit.Fields["name"].(string); ok {
+			l.Name = v
+		}
+		if v, ok := hit.Fields["path"].(string); ok {
+			l.Path = v
+		}
+		if v, ok := hit.Fields["last_scan_at"].(string); ok && v != "" {
+			l.LastScanAt, _ = time.Parse(time.RFC3339, v)
+		}
+		libs = append(libs, l)
+	}
+	return libs, nil
+}
+
+// userDocID is the Bleve document id a user is stored under in libIndex,
+// which doubles as the small admin-metadata index for both Libraries and
+// Subsonic users.
+func userDocID(username string) string {
+	return "user:" + username
+}
+
+// AddUser registers a user with password exactly as given, used by the
+// Subsonic API's token+salt auth (main.go's --add-user passes it through
+// subsonic.go's encryptUserPassword before calling AddUser).
+func (b *BleveStore) AddUser(username, password string) error {
+	return b.libIndex.Index(userDocID(username), struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{username, password})
+}
+
+// UserPassword returns the stored password for username, and whether the
+// user exists at all.
+func (b *BleveStore) UserPassword(username string) (string, bool, error) {
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{userDocID(username)}))
+	req.Fields = []string{"*"}
+	res, err := b.libIndex.Search(req)
+	if err != nil {
+		return "", false, err
+	}
+	if len(res.Hits) == 0 {
+		return "", false, nil
+	}
+	password, _ := res.Hits[0].Fields["password"].(string)
+	return password, true, nil
+}
+
+// settingDocID is the Bleve document id a setting is stored under in
+// libIndex, alongside Libraries and users.
+func settingDocID(key string) string {
+	return "setting:" + key
+}
+
+// GetSetting returns the stored value for key and whether it was set at all.
+func (b *BleveStore) GetSetting(key string) (string, bool, error) {
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{settingDocID(key)}))
+	req.Fields = []string{"*"}
+	res, err := b.libIndex.Search(req)
+	if err != nil {
+		return "", false, err
+	}
+	if len(res.Hits) == 0 {
+		return "", false, nil
+	}
+	value, _ := res.Hits[0].Fields["value"].(string)
+	return value, true, nil
+}
+
+// SetSetting stores value under key, overwriting any previous value.
+func (b *BleveStore) SetSetting(key, value string) error {
+	return b.libIndex.Index(settingDocID(key), struct {
+		Value string `json:"value"`
+	}{value})
+}
+
+// pendingListenDocID is the Bleve document id a queued listen is stored
+// under in libIndex.
+func pendingListenDocID(id int64) string {
+	return fmt.Sprintf("pending_listen:%d", id)
+}
+
+// QueuePendingListen records a listen that couldn't be submitted
+// immediately, for replay via PendingListens/RemovePendingListen.
+func (b *BleveStore) QueuePendingListen(l PendingListen) error {
+	listens, err := b.PendingListens()
+	if err != nil {
+		return err
+	}
+	var id int64 = 1
+	for _, existing := range listens {
+		if existing.ID >= id {
+			id = existing.ID + 1
+		}
+	}
+	l.ID = id
+	return b.libIndex.Index(pendingListenDocID(id), struct {
+		Artist   string `json:"artist"`
+		Title    string `json:"title"`
+		Album    string `json:"album"`
+		PlayedAt string `json:"played_at"`
+	}{l.Artist, l.Title, l.Album, l.PlayedAt.Format(time.RFC3339)})
+}
+
+// PendingListens returns all listens queued by QueuePendingListen, oldest
+// first. libIndex has no "WHERE id LIKE" concept, so this matches
+// everything and filters by doc-id prefix, the same way ListLibraries
+// walks the whole index rather than querying it.
+func (b *BleveStore) PendingListens() ([]PendingListen, error) {
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = 10000
+	req.Fields = []string{"*"}
+	res, err := b.libIndex.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var listens []PendingListen
+	for _, hit := range res.Hits {
+		if !strings.HasPrefix(hit.ID, "pending_listen:") {
+			continue
+		}
+		var l PendingListen
+		fmt.Sscanf(hit.ID, "pending_listen:%d", &l.ID)
+		l.Artist, _ = hit.Fields["artist"].(string)
+		l.Title, _ = hit.Fields["title"].(string)
+		l.Album, _ = hit.Fields["album"].(string)
+		if v, ok := hit.Fields["played_at"].(string); ok {
+			l.PlayedAt, _ = time.Parse(time.RFC3339, v)
+		}
+		listens = append(listens, l)
+	}
+	sort.Slice(listens, func(i, j int) bool { return listens[i].ID < listens[j].ID })
+	return listens, nil
+}
+
+// RemovePendingListen deletes a queued listen once it's been successfully submitted.
+func (b *BleveStore) RemovePendingListen(id int64) error {
+	return b.libIndex.Delete(pendingListenDocID(id))
+}
+
 func (b *BleveStore) Clear() error {
 	// Bleve doesn't have a simple "Clear".
 	// The easiest way is to close, remove dir, and re-init.
@@ -56,9 +279,12 @@ func (b *BleveStore) Clear() error {
 	return nil 
 }
 
-func (b *BleveStore) IndexMediaBatch(batch []*Media) error {
+func (b *BleveStore) IndexMediaBatch(batch []*Media, libraryID int64) error {
 	batchIndex := b.index.NewBatch()
 	for _, m := range batch {
+		if libraryID != 0 {
+			m.LibraryID = libraryID
+		}
 		// Use Path as ID to ensure uniqueness and allow updates
 		err := batchIndex.Index(m.Path, m)
 		if err != nil {
@@ -68,19 +294,47 @@ func (b *BleveStore) IndexMediaBatch(batch []*Media) error {
 	return b.index.Batch(batchIndex)
 }
 
+// UpdateLastScan records that libraryID was just scanned, so a future
+// --freshen run only looks at files modified since.
+func (b *BleveStore) UpdateLastScan(libraryID int64, at time.Time) error {
+	libs, err := b.ListLibraries()
+	if err != nil {
+		return err
+	}
+	for _, l := range libs {
+		if l.ID == libraryID {
+			l.LastScanAt = at
+			return b.libIndex.Index(libraryDocID(libraryID), l)
+		}
+	}
+	return nil
+}
+
 func (b *BleveStore) Count() (int, error) {
 	c, err := b.index.DocCount()
 	return int(c), err
 }
 
-func (b *BleveStore) GetAllPaths() ([]string, error) {
+// libraryIDQuery matches Media documents indexed under libraryID.
+func libraryIDQuery(libraryID int64) bleveQuery.Query {
+	v := float64(libraryID)
+	t := true
+	q := bleve.NewNumericRangeInclusiveQuery(&v, &v, &t, &t)
+	q.SetField("library_id")
+	return q
+}
+
+func (b *BleveStore) GetAllPaths(libraryID int64) ([]string, error) {
 	// Helper to retrieve all IDs (paths)
-	// Iterate using a MatchAll query
-	q := bleve.NewMatchAllQuery()
+	// Iterate using a MatchAll query, optionally scoped to a library
+	var q bleveQuery.Query = bleve.NewMatchAllQuery()
+	if libraryID != 0 {
+		q = libraryIDQuery(libraryID)
+	}
 	req := bleve.NewSearchRequest(q)
 	req.Size = 1000000 // A large enough number, or paginate
 	// We only need the ID
-	req.Fields = []string{} 
+	req.Fields = []string{}
 
 	res, err := b.index.Search(req)
 	if err != nil {
@@ -94,8 +348,21 @@ func (b *BleveStore) GetAllPaths() ([]string, error) {
 	return paths, nil
 }
 
-func (b *BleveStore) RemoveStaleEntries() (int, error) {
-	paths, err := b.GetAllPaths()
+// PathIndexed reports whether path is currently indexed, via a single
+// doc-id lookup (Media documents are indexed under their Path, see
+// IndexMediaBatch) rather than GetAllPaths(0)'s whole-index fetch.
+func (b *BleveStore) PathIndexed(path string) (bool, error) {
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{path}))
+	req.Fields = nil
+	res, err := b.index.Search(req)
+	if err != nil {
+		return false, err
+	}
+	return len(res.Hits) > 0, nil
+}
+
+func (b *BleveStore) RemoveStaleEntries(libraryID int64) (int, error) {
+	paths, err := b.GetAllPaths(libraryID)
 	if err != nil {
 		return 0, err
 	}
@@ -112,44 +379,64 @@ func (b *BleveStore) RemoveStaleEntries() (int, error) {
 	return removed, err
 }
 
-func (b *BleveStore) Search(input string) ([]Media, error) {
-	if input == "" {
-		// Match All
-		q := bleve.NewMatchAllQuery()
-		return b.runQuery(q)
-	}
+// bleveSortMappings maps QueryOptions.Sort values to Bleve SortBy field
+// lists, mirroring sqliteSortMappings/pgSortMappings. Bleve keeps no
+// insertion order, so "recently_added" sorts by document id (the file
+// path), descending by default.
+var bleveSortMappings = map[string][]string{
+	"artist":         {"orderartistname", "orderalbumname", "discnumber", "tracknumber"},
+	"album":          {"orderalbumname", "orderartistname", "discnumber", "tracknumber"},
+	"title":          {"title"},
+	"recently_added": {"-_id"},
+}
 
-	// First try to parse as strict query string (e.g. "artist:Rolling")
-	// If the user inputs simple text "rolling", QueryStringQuery handles it too.
-	// But SMJ7 syntax uses special chars (!, @, #, $).
-	// We should convert SMJ7 syntax to Bleve Query String syntax if possible,
-	// OR just implement a custom logic like SQLiteStore does but constructing a BooleanQuery.
+func (b *BleveStore) Search(opts QueryOptions) ([]Media, error) {
+	input := opts.Query
 
-	// SMJ7 Syntax Mapping:
-	// !genre -> genre:value
-	// @artist -> artist:value
-	// #album -> album:value
-	// $track -> title:value
-	// simple -> (+artist:simple +album:simple +title:simple) (Disjunction)
+	var q bleveQuery.Query
+	switch {
+	case input == "":
+		q = bleve.NewMatchAllQuery()
+	case strings.ContainsAny(input, "!@#$^%") || strings.Contains(input, ","):
+		q = b.smj7Query(input)
+	default:
+		// Fallback/Default: Use Bleve's Query String Syntax. This enables
+		// fuzzy search, field scoping, etc. for non-SMJ7 input like
+		// "artist:rolling~2".
+		q = bleve.NewQueryStringQuery(input)
+	}
 
-	// HOWEVER, user asked for "Bleve-specific capabilities". 
-	// If the input doesn't look like SMJ7 syntax (no prefix chars), we can pass it to QueryStringQuery directly
-	// to allow "artist:rolling~2" etc.
-	
-	// Let's try to detect if it's SMJ7 style.
-	if strings.ContainsAny(input, "!@#$") || strings.Contains(input, ",") {
-		// Parse SMJ7 style and build a boolean query
-		return b.searchSMJ7Style(input)
+	if len(opts.Filters) > 0 || opts.LibraryID != 0 {
+		filtered := bleve.NewBooleanQuery()
+		filtered.AddMust(q)
+		for key, value := range opts.Filters {
+			s, ok := value.(string)
+			if !ok {
+				continue
+			}
+			switch key {
+			case "genre":
+				mq := bleve.NewMatchQuery(s)
+				mq.SetField("genres")
+				filtered.AddMust(mq)
+			case "artist", "album":
+				mq := bleve.NewMatchQuery(s)
+				mq.SetField(key)
+				filtered.AddMust(mq)
+			}
+		}
+		if opts.LibraryID != 0 {
+			filtered.AddMust(libraryIDQuery(opts.LibraryID))
+		}
+		q = filtered
 	}
 
-	// Fallback/Default: Use Bleve's Query String Syntax
-	// This enables fuzzy search, field scoping, etc.
-	q := bleve.NewQueryStringQuery(input)
-	return b.runQuery(q)
+	return b.runQuery(q, opts)
 }
 
-func (b *BleveStore) searchSMJ7Style(input string) ([]Media, error) {
-	var genreParams, artistParams, albumParams, titleParams, multiParams []string
+func (b *BleveStore) smj7Query(input string) bleveQuery.Query {
+	var genreParams, artistParams, albumParams, titleParams, mbidParams, multiParams []string
+	tagParams := make(map[string][]string)
 	for _, word := range strings.Split(input, ",") {
 		word = strings.TrimSpace(word)
 		if word == "" {
@@ -163,6 +450,12 @@ func (b *BleveStore) searchSMJ7Style(input string) ([]Media, error) {
 			albumParams = append(albumParams, word[1:])
 		} else if strings.HasPrefix(word, "$") {
 			titleParams = append(titleParams, word[1:])
+		} else if strings.HasPrefix(word, "^") {
+			mbidParams = append(mbidParams, word[1:])
+		} else if strings.HasPrefix(word, "%") {
+			if name, value, ok := strings.Cut(word[1:], ":"); ok {
+				tagParams[name] = append(tagParams[name], value)
+			}
 		} else {
 			multiParams = append(multiParams, word)
 		}
@@ -184,11 +477,38 @@ func (b *BleveStore) searchSMJ7Style(input string) ([]Media, error) {
 		mainBoolQuery.AddMust(subQuery)
 	}
 
-	addOrGroup(genreParams, "genre")
+	addOrGroup(genreParams, "genres")
 	addOrGroup(artistParams, "artist")
 	addOrGroup(albumParams, "album")
 	addOrGroup(titleParams, "title")
 
+	// "^" matches any MusicBrainz id field, same as the SQLite/Postgres
+	// backends' MBIDParams handling in sqlBuilder.whereFromFilter.
+	if len(mbidParams) > 0 {
+		subQuery := bleve.NewBooleanQuery()
+		for _, t := range mbidParams {
+			for _, field := range []string{"mbid", "mbid_album", "mbid_artist", "mbid_album_artist", "mbid_release_group"} {
+				mq := bleve.NewMatchQuery(t)
+				mq.SetField(field)
+				subQuery.AddShould(mq)
+			}
+		}
+		mainBoolQuery.AddMust(subQuery)
+	}
+
+	// "%tagname:value" matches the dynamically-mapped "tags.<tagname>"
+	// field Bleve creates for the Tags map, same rich-tag bag the
+	// SQLite/Postgres backends query via item_tags/JSONB.
+	for name, values := range tagParams {
+		subQuery := bleve.NewBooleanQuery()
+		for _, v := range values {
+			mq := bleve.NewMatchQuery(v)
+			mq.SetField("tags." + name)
+			subQuery.AddShould(mq)
+		}
+		mainBoolQuery.AddMust(subQuery)
+	}
+
 	if len(multiParams) > 0 {
 		subQuery := bleve.NewBooleanQuery()
 		for _, t := range multiParams {
@@ -201,18 +521,44 @@ func (b *BleveStore) searchSMJ7Style(input string) ([]Media, error) {
 		mainBoolQuery.AddMust(subQuery)
 	}
 
-	return b.runQuery(mainBoolQuery)
+	return mainBoolQuery
 }
 
-func (b *BleveStore) runQuery(q bleveQuery.Query) ([]Media, error) {
+func (b *BleveStore) runQuery(q bleveQuery.Query, opts QueryOptions) ([]Media, error) {
 	req := bleve.NewSearchRequest(q)
-	req.Size = 1000 // Limit results? 
+	if opts.Max > 0 {
+		req.Size = opts.Max
+	} else {
+		// Max 0 means "no limit": size the request to the whole index.
+		count, err := b.index.DocCount()
+		if err != nil {
+			return nil, err
+		}
+		req.Size = int(count)
+	}
+	req.From = opts.Offset
 	req.Fields = []string{"*"} // Load all fields
-	
-	// Sort by Artist, Album, Disc, Track
-	// Bleve sorting is strings by default. Numeric sorting requires numeric indexing.
-	// Default default mapping guesses types.
-	req.SortBy([]string{"artist", "album", "discnumber", "tracknumber"})
+
+	// Sort by the locale-aware derived order names rather than raw
+	// artist/album, so "The Beatles" sorts under B like the SQLite/Postgres
+	// backends. Bleve sorting is strings by default; numeric sorting
+	// requires numeric indexing, which the default mapping infers for us.
+	sortBy, ok := bleveSortMappings[opts.Sort]
+	if !ok {
+		sortBy = []string{"orderartistname", "orderalbumname", "discnumber", "tracknumber"}
+	}
+	if strings.EqualFold(opts.Order, "desc") {
+		reversed := make([]string, len(sortBy))
+		for i, f := range sortBy {
+			if strings.HasPrefix(f, "-") {
+				reversed[i] = strings.TrimPrefix(f, "-")
+			} else {
+				reversed[i] = "-" + f
+			}
+		}
+		sortBy = reversed
+	}
+	req.SortBy(sortBy)
 
 	res, err := b.index.Search(req)
 	if err != nil {
@@ -243,12 +589,87 @@ func (b *BleveStore) runQuery(q bleveQuery.Query) ([]Media, error) {
 		m.Title = getStr("title")
 		m.Artist = getStr("artist")
 		m.Album = getStr("album")
-		m.Genre = getStr("genre")
 		m.Path = getStr("path")
 		m.TrackNumber = getInt("tracknumber")
 		m.DiscNumber = getInt("discnumber")
-		
+		m.LibraryID = int64(getInt("library_id"))
+
+		m.MBID = getStr("mbid")
+		m.MBIDAlbum = getStr("mbid_album")
+		m.MBIDArtist = getStr("mbid_artist")
+		m.MBIDAlbumArtist = getStr("mbid_album_artist")
+		m.MBIDReleaseGroup = getStr("mbid_release_group")
+
+		// "genres" is indexed as a repeated field; Bleve returns repeated
+		// fields back as []interface{} rather than a single scalar.
+		switch v := hit.Fields["genres"].(type) {
+		case string:
+			m.Genres = []string{v}
+		case []interface{}:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					m.Genres = append(m.Genres, s)
+				}
+			}
+		}
+
+		// The Tags map is indexed as nested "tags.<name>" fields; rebuild
+		// it from every hit field under that prefix.
+		for field, v := range hit.Fields {
+			name := strings.TrimPrefix(field, "tags.")
+			if name == field {
+				continue
+			}
+			switch val := v.(type) {
+			case string:
+				if m.Tags == nil {
+					m.Tags = make(map[string][]string)
+				}
+				m.Tags[name] = append(m.Tags[name], val)
+			case []interface{}:
+				for _, item := range val {
+					if s, ok := item.(string); ok {
+						if m.Tags == nil {
+							m.Tags = make(map[string][]string)
+						}
+						m.Tags[name] = append(m.Tags[name], s)
+					}
+				}
+			}
+		}
+
 		results = append(results, m)
 	}
 	return results, nil
 }
+
+// Tags returns the distinct values seen for the given tag name, with
+// per-value song counts, computed via a Bleve facet over the whole index.
+// "genre" is special-cased to the "genres" field it's indexed under; every
+// other name is a rich tag indexed under "tags.<name>" (see runQuery's hit
+// parsing and extractExtraTags).
+func (b *BleveStore) Tags(name string) ([]TagCount, error) {
+	if name == "genre" {
+		name = "genres"
+	} else {
+		name = "tags." + name
+	}
+
+	req := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	req.Size = 0
+	facet := bleve.NewFacetRequest(name, math.MaxInt32)
+	req.AddFacet(name, facet)
+
+	res, err := b.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []TagCount
+	if fr, ok := res.Facets[name]; ok {
+		for _, term := range fr.Terms.Terms() {
+			counts = append(counts, TagCount{Value: term.Term, Count: term.Count})
+		}
+	}
+	return counts, nil
+}
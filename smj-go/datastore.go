@@ -1,42 +1,218 @@
 package main
 
+import "time"
+
+// Library represents one scanned music root (analogous to a repeatable
+// -music-path). Multiple libraries let a single catalog combine, e.g., a
+// local FLAC collection and a network-mounted MP3 archive under one
+// catalog without path collisions, and let the scanner skip untouched
+// roots based on LastScanAt.
+type Library struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	LastScanAt time.Time `json:"last_scan_at,omitempty"`
+}
+
+// Folder is a physical root indexed under a Library. Today each Library
+// has exactly one implicit Folder at its own Path; the type is split out
+// so a Library can later span several physical roots (e.g. two NAS mounts
+// registered as one named library) without another schema change.
+type Folder struct {
+	ID        int64  `json:"id"`
+	LibraryID int64  `json:"library_id"`
+	Path      string `json:"path"`
+}
+
 // Media represents a single media file and its metadata.
 type Media struct {
-	Title       string `json:"title"`
-	Artist      string `json:"artist"`
-	Album       string `json:"album"`
-	TrackNumber int    `json:"tracknumber"`
-	DiscNumber  int    `json:"discnumber"`
-	Genre       string `json:"genre"`
-	Path        string `json:"path"`
+	Title       string   `json:"title"`
+	Artist      string   `json:"artist"`
+	Album       string   `json:"album"`
+	TrackNumber int      `json:"tracknumber"`
+	DiscNumber  int      `json:"discnumber"`
+	Genres      []string `json:"genres"`
+	Path        string   `json:"path"`
+
+	// LibraryID is the Library this entry was indexed under. 0 means it
+	// predates library support and isn't scoped to any root.
+	LibraryID int64 `json:"library_id,omitempty"`
+
+	// MusicBrainz identifiers, populated when a file's tags include them.
+	// Grouping (see artistGroupKey/albumGroupKey) and the SMJ7 "^" query
+	// prefix prefer these over names, since two distinct artists can share
+	// a display name and a live/studio pair can share an album title.
+	MBID             string `json:"mbid,omitempty"`
+	MBIDAlbum        string `json:"mbid_album,omitempty"`
+	MBIDArtist       string `json:"mbid_artist,omitempty"`
+	MBIDAlbumArtist  string `json:"mbid_album_artist,omitempty"`
+	MBIDReleaseGroup string `json:"mbid_release_group,omitempty"`
+
+	// Tags holds metadata beyond the fixed fields above (composer,
+	// conductor, mood, BPM, compilation flag, disc subtitle, free-form
+	// comments, ...), keyed by a normalized tag name with one or more
+	// values. Queried via the SMJ7 "%tagname:value" selector; see
+	// extractExtraTags for what gets populated here.
+	Tags map[string][]string `json:"tags,omitempty"`
+
+	// Sort tags, populated from ID3v2 TSOT/TSOP/TSOA (or Vorbis equivalents)
+	// when the file provides them. Empty when absent.
+	SortTitle  string `json:"sorttitle,omitempty"`
+	SortArtist string `json:"sortartist,omitempty"`
+	SortAlbum  string `json:"sortalbum,omitempty"`
+
+	// OrderArtistName and OrderAlbumName are derived sort keys: lowercased,
+	// diacritic-folded, and with a leading article stripped (see
+	// NormalizeOrderName). Backends use these for ORDER BY so "The Beatles"
+	// sorts under B and "Café Tacvba" sorts the same as "Cafe Tacvba".
+	OrderArtistName string `json:"orderartistname"`
+	OrderAlbumName  string `json:"orderalbumname"`
+}
+
+// PendingListen is a scrobble queued by the scrobble subsystem (see
+// scrobble.go) because it couldn't be submitted immediately, for replay
+// via Datastore.PendingListens on the next startup.
+type PendingListen struct {
+	ID       int64
+	Artist   string
+	Title    string
+	Album    string
+	PlayedAt time.Time
+}
+
+// TagCount is a single distinct tag value together with how many songs carry it.
+// Returned by Datastore.Tags to support faceted "browse by tag" UIs.
+type TagCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// QueryOptions generalizes a Search call beyond a bare SMJ7 query string,
+// carrying the offset/limit/sort/filter knobs a future HTTP layer (or the
+// CLI's own --max/--sort flags) needs for pagination and ordering.
+// SQLiteStore and PostgresStore translate this into WHERE/ORDER BY/LIMIT/
+// OFFSET; BleveStore translates it into SearchRequest.From/Size/SortBy.
+type QueryOptions struct {
+	// Query is an SMJ7-style query string, same syntax as the original
+	// string-based Search.
+	Query string
+
+	// Filters add exact-match constraints beyond Query, by key: "genre",
+	// "artist" and "album" (see SQLiteStore's filterClause). Keys a
+	// backend doesn't recognize are ignored.
+	Filters map[string]any
+
+	// Sort is looked up in each backend's sortMappings to pick an ORDER BY
+	// (or Bleve SortBy) clause; unrecognized values fall back to the
+	// default artist/album/disc/track ordering.
+	Sort  string
+	Order string // "asc" (default) or "desc"
+
+	Offset int
+	Max    int // 0 means "no limit"
+
+	// LibraryID restricts results to one registered Library; 0 means "all
+	// libraries".
+	LibraryID int64
 }
 
 // Datastore is the interface that any backend must implement.
 type Datastore interface {
 	// Initialize prepares the datastore (e.g., create tables, open index).
 	Initialize(path string) error
-	
+
 	// Close cleans up resources.
 	Close() error
-	
-	// IndexMediaBatch adds or updates a batch of media entries.
-	IndexMediaBatch(batch []*Media) error
-	
+
+	// AddLibrary registers a new music root and returns its id.
+	AddLibrary(name, path string) (int64, error)
+
+	// RemoveLibrary deletes a library registration and everything indexed
+	// under it.
+	RemoveLibrary(id int64) error
+
+	// ListLibraries returns all registered music roots.
+	ListLibraries() ([]Library, error)
+
+	// UpdateLastScan records that libraryID was just scanned at the given
+	// time, so a later --freshen run can compare file mtimes against it
+	// instead of the database file's own mtime.
+	UpdateLastScan(libraryID int64, at time.Time) error
+
+	// IndexMediaBatch adds or updates a batch of media entries, scoping
+	// them to libraryID (0 keeps each entry's own LibraryID).
+	IndexMediaBatch(batch []*Media, libraryID int64) error
+
 	// Count returns the total number of media entries.
 	Count() (int, error)
-	
-	// Search returns media entries matching the query string.
-	// If query is empty, it should return all entries (or a reasonable default).
-	Search(query string) ([]Media, error)
-	
-	// RemoveStaleEntries checks all entries and removes those that no longer exist on disk.
-	// Returns the number of removed entries.
-	RemoveStaleEntries() (int, error)
-	
-	// GetAllPaths returns a list of all file paths currently in the store.
-	// This is useful for efficient freshening or staleness checks.
-	GetAllPaths() ([]string, error)
-
-	// Clear removes all data from the store.
+
+	// Search returns media entries matching opts. If opts.Query is empty
+	// and no filters are set, it should return all entries (or a
+	// reasonable default).
+	Search(opts QueryOptions) ([]Media, error)
+
+	// RemoveStaleEntries checks entries scoped to libraryID (0 means all)
+	// and removes those that no longer exist on disk. Returns the number
+	// of removed entries.
+	RemoveStaleEntries(libraryID int64) (int, error)
+
+	// GetAllPaths returns all file paths currently in the store, scoped to
+	// libraryID (0 means all). This is useful for efficient freshening or
+	// staleness checks.
+	GetAllPaths(libraryID int64) ([]string, error)
+
+	// PathIndexed reports whether path is currently indexed in the store,
+	// without fetching every other path the way GetAllPaths(0) would.
+	// Used by subsonic.go to validate a song id resolves to a real
+	// indexed file before serving it.
+	PathIndexed(path string) (bool, error)
+
+	// Clear removes all media data from the store. Library registrations
+	// survive a Clear, since they describe roots to rescan, not scanned data.
 	Clear() error
+
+	// Tags returns the distinct values seen for a multi-valued tag (e.g.
+	// "genre", "composer", "mood"), each with the number of songs carrying it.
+	Tags(name string) ([]TagCount, error)
+
+	// AddUser registers a user, replacing any existing password for that
+	// username. password is whatever the caller passes in; callers that
+	// want it unrecoverable from the datastore at rest should pass
+	// encryptUserPassword's output rather than a plaintext password (see
+	// subsonic.go, whose token+salt auth needs the plaintext back, so it
+	// can't be hashed one-way).
+	AddUser(username, password string) error
+
+	// UserPassword returns the stored password for username (exactly what
+	// was passed to AddUser), and whether the user exists at all.
+	UserPassword(username string) (string, bool, error)
+
+	// GetSetting returns the stored value for key and whether it was set
+	// at all, distinguishing "never configured" from "configured as
+	// empty". Used for per-install config like scrobble service tokens
+	// (see scrobble.go) that doesn't warrant its own column/flag.
+	GetSetting(key string) (string, bool, error)
+
+	// SetSetting stores value under key, overwriting any previous value.
+	SetSetting(key, value string) error
+
+	// QueuePendingListen records a listen that couldn't be submitted
+	// immediately, for replay via PendingListens/RemovePendingListen on
+	// the next startup.
+	QueuePendingListen(l PendingListen) error
+
+	// PendingListens returns all listens queued by QueuePendingListen,
+	// oldest first.
+	PendingListens() ([]PendingListen, error)
+
+	// RemovePendingListen deletes a queued listen once it's been
+	// successfully submitted (or permanently given up on).
+	RemovePendingListen(id int64) error
+}
+
+// SearchString is a thin backward-compatible wrapper around the
+// QueryOptions-based Search, for callers that only ever searched by an
+// SMJ7 query string.
+func SearchString(store Datastore, query string) ([]Media, error) {
+	return store.Search(QueryOptions{Query: query})
 }
@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// GenreSeparators lists the characters the scanner splits a raw genre (or
+// other multi-valued tag) string on to produce distinct tag values.
+// Configurable via --genre-separators for libraries tagged with an
+// unusual delimiter.
+var GenreSeparators = ";/,"
+
+// SplitTagValue splits a raw tag string (as read off a file) into its
+// distinct values using GenreSeparators, trimming whitespace and dropping
+// empties.
+func SplitTagValue(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	var values []string
+	for _, part := range strings.FieldsFunc(raw, func(r rune) bool {
+		return strings.ContainsRune(GenreSeparators, r)
+	}) {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
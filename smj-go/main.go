@@ -9,7 +9,6 @@ import (
 	"math"
 	"math/rand"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
@@ -19,6 +18,9 @@ import (
 	"time"
 
 	"github.com/dhowden/tag"
+	"golang.org/x/term"
+
+	"github.com/ThatDevopsGuy/multimedia/smj-go/player"
 )
 
 var (
@@ -35,8 +37,30 @@ var (
 	showSyntax   bool
 	debug        bool
 	useDocBackend bool
+	sortField    string
+	sortOrder    string
+	maxResults   int
+	resultOffset int
+	serve        bool
+	listenAddr   string
+	addUser      string
+	libraryFlags stringListFlag
+	playerKind   string
+	nowPlaying   bool
 )
 
+// stringListFlag implements flag.Value for a flag that may be repeated on
+// the command line, accumulating one entry per occurrence (flag.StringVar
+// only keeps the last).
+type stringListFlag []string
+
+func (f *stringListFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringListFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func truePath(path string) string {
 	if strings.HasPrefix(path, "~") {
 		home, _ := os.UserHomeDir()
@@ -68,9 +92,47 @@ func init() {
 	flag.BoolVar(&debug, "d", false, "enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "enable debug mode")
 	flag.BoolVar(&useDocBackend, "use-document-backend", false, "use experimental Bleve document backend")
+	flag.BoolVar(&PreferSortTags, "prefer-sort-tags", false, "order results by a file's TSOP/TSOA sort tags when present, falling back to the derived order name")
+	flag.StringVar(&sortField, "sort", "", "sort results by a registered field (artist, album, title, recently_added)")
+	flag.StringVar(&sortOrder, "order", "", "asc (default) or desc")
+	flag.IntVar(&maxResults, "max", 0, "maximum number of results to return (0 means no limit)")
+	flag.IntVar(&resultOffset, "offset", 0, "number of results to skip before returning, for pagination")
+	flag.BoolVar(&serve, "serve", false, "expose the indexed library over the Subsonic API instead of running the CLI")
+	flag.StringVar(&listenAddr, "listen", ":4040", "with --serve, the address to listen on")
+	flag.StringVar(&addUser, "add-user", "", "register a Subsonic API user as \"name:password\" and exit")
+	flag.Var(&libraryFlags, "library", "a music root as \"name=path\"; repeatable to scan multiple libraries instead of --location")
+	flag.StringVar(&playerKind, "player", "embedded", "playback backend: embedded (default, no external dependency) or mpv")
+	flag.BoolVar(&nowPlaying, "now-playing", false, "send a ListenBrainz \"now playing\" heartbeat when a track starts")
+	flag.StringVar(&GenreSeparators, "genre-separators", GenreSeparators, "characters used to split a multi-valued genre/tag field into separate values")
+	flag.Var(sortArticlesFlag{}, "sort-articles", "comma-separated leading articles to strip when deriving sort order, e.g. \"the,a,an,el,la\"")
+}
+
+// queryOptionsFromFlags builds a QueryOptions for q using the --sort,
+// --order, --max, and --offset flags, so a single -q invocation can request
+// e.g. sort=recently_added order=desc max=50 the same way a REST client would.
+func queryOptionsFromFlags(q string) QueryOptions {
+	return QueryOptions{
+		Query:  q,
+		Sort:   sortField,
+		Order:  sortOrder,
+		Max:    maxResults,
+		Offset: resultOffset,
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "use_mbzid" {
+		flag.CommandLine.Parse(os.Args[2:])
+		runUseMBZID()
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "auth" && os.Args[2] == "listenbrainz" {
+		flag.CommandLine.Parse(os.Args[3:])
+		runAuthListenBrainz()
+		return
+	}
+
 	flag.Parse()
 
 	if showSyntax {
@@ -83,6 +145,25 @@ func main() {
 
 	// Determine backend
 	var store Datastore
+
+	if isPostgresDSN(databasePath) {
+		store = &PostgresStore{}
+		if err := store.Initialize(databasePath); err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		if forceRescan {
+			if err := store.Clear(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if handleAddUserAndServe(store) {
+			return
+		}
+		runLibraryCommands(store, location)
+		return
+	}
+
 	sqliteExists := fileExists(databasePath)
 	blevePath := strings.TrimSuffix(databasePath, ".sqlite") + ".bleve"
 	bleveExists := fileExists(blevePath)
@@ -141,29 +222,158 @@ func main() {
 	}
 	defer store.Close()
 
-	if _, err := os.Stat(location); os.IsNotExist(err) {
-		log.Fatalf("Cannot scan a nonexistent path: \"%s\"", location)
+	if handleAddUserAndServe(store) {
+		return
 	}
 
-	if forceRescan {
-		// Re-init happens inside Initialize usually, but if we deleted it above, Initialize recreated it empty.
-		indexMedia(store, location, false)
-	} else if freshen {
-		indexMedia(store, location, true)
+	runLibraryCommands(store, location)
+}
+
+// handleAddUserAndServe handles the --add-user and --serve flags, which
+// both bypass the normal scan/prune/query CLI flow. Returns true if it
+// handled the invocation and main should return.
+func handleAddUserAndServe(store Datastore) bool {
+	if addUser != "" {
+		name, password, ok := strings.Cut(addUser, ":")
+		if !ok {
+			log.Fatal("--add-user expects \"name:password\"")
+		}
+		encrypted, err := encryptUserPassword(store, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.AddUser(name, encrypted); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("User %q added.\n", name)
+		return true
+	}
+
+	if serve {
+		if err := serveSubsonic(store, listenAddr); err != nil {
+			log.Fatal(err)
+		}
+		return true
+	}
+
+	return false
+}
+
+// runUseMBZID is the `smj-go use_mbzid` subcommand: it finds entries still
+// missing a MusicBrainz id, re-parses those files in case the tags have
+// since gained one, and after a dry-run confirmation writes the backfilled
+// ids back. Once present, artistGroupKey/albumGroupKey (used by the
+// Subsonic API's getArtists/getAlbumList2) key grouping on the MBID
+// instead of the name.
+func runUseMBZID() {
+	if !isPostgresDSN(databasePath) {
+		databasePath = truePath(databasePath)
+	}
+
+	var store Datastore
+	blevePath := strings.TrimSuffix(databasePath, ".sqlite") + ".bleve"
+	switch {
+	case isPostgresDSN(databasePath):
+		store = &PostgresStore{}
+	case fileExists(blevePath):
+		store = &BleveStore{}
+		databasePath = blevePath
+	default:
+		store = &SQLiteStore{}
+	}
+	if err := store.Initialize(databasePath); err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	results, err := store.Search(QueryOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var toUpdate []*Media
+	for i := range results {
+		m := results[i]
+		if m.MBID != "" && m.MBIDAlbum != "" && m.MBIDArtist != "" {
+			continue
+		}
+
+		f, err := os.Open(m.Path)
+		if err != nil {
+			continue
+		}
+		tags, err := tag.ReadFrom(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+
+		mbid, mbidAlbum, mbidArtist, mbidAlbumArtist, mbidReleaseGroup := musicBrainzIDs(tags)
+		if mbid == "" && mbidAlbum == "" && mbidArtist == "" && mbidAlbumArtist == "" && mbidReleaseGroup == "" {
+			continue
+		}
+		m.MBID, m.MBIDAlbum, m.MBIDArtist, m.MBIDAlbumArtist, m.MBIDReleaseGroup = mbid, mbidAlbum, mbidArtist, mbidAlbumArtist, mbidReleaseGroup
+		toUpdate = append(toUpdate, &m)
+	}
+
+	if len(toUpdate) == 0 {
+		fmt.Println("use_mbzid: no additional MusicBrainz ids found to backfill.")
+		return
+	}
+
+	fmt.Printf("use_mbzid: found MusicBrainz ids to backfill for %d of %d entries.\n", len(toUpdate), len(results))
+	fmt.Print("Write these changes now? [y/N] ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() || strings.ToLower(strings.TrimSpace(scanner.Text())) != "y" {
+		fmt.Println("use_mbzid: dry run only, no changes written.")
+		return
+	}
+
+	if err := store.IndexMediaBatch(toUpdate, 0); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("use_mbzid: backfilled MusicBrainz ids for %d entries.\n", len(toUpdate))
+}
+
+// runLibraryCommands drives scanning, pruning, and querying against an
+// already-Initialize'd store. It's shared across backends: the Postgres
+// path runs it directly, while SQLite/Bleve run it after their
+// first-launch backend-selection and force-rescan handling above.
+func runLibraryCommands(store Datastore, location string) {
+	replayPendingListens(store)
+
+	libraries := resolveLibraries(store, location)
+
+	for _, lib := range libraries {
+		if _, err := os.Stat(lib.Path); os.IsNotExist(err) {
+			log.Printf("Skipping library %q: nonexistent path %q", lib.Name, lib.Path)
+			continue
+		}
+
+		if forceRescan {
+			// Re-init happens inside Initialize usually, but if we deleted it above, Initialize recreated it empty.
+			indexMedia(store, lib.Path, false, lib.ID, time.Time{})
+		} else if freshen {
+			indexMedia(store, lib.Path, true, lib.ID, lib.LastScanAt)
+		}
 	}
 
 	if prune {
-		removed, _ := store.RemoveStaleEntries()
-		fmt.Printf("Pruner: Removed %d stale files.\n", removed)
+		for _, lib := range libraries {
+			removed, _ := store.RemoveStaleEntries(lib.ID)
+			fmt.Printf("Pruner: Removed %d stale files from %q.\n", removed, lib.Name)
+		}
 	}
 
 	count, _ := store.Count()
 	if count == 0 && !freshen && !forceRescan {
-		indexMedia(store, location, false)
+		for _, lib := range libraries {
+			indexMedia(store, lib.Path, false, lib.ID, time.Time{})
+		}
 	}
 
 	if outputJSON && query == "" {
-		results, _ := store.Search("")
+		results, _ := store.Search(queryOptionsFromFlags(""))
 		fmt.Println(jsonizer(results))
 		return
 	}
@@ -177,19 +387,79 @@ func main() {
 			cmd = strings.TrimSpace(parts[1])
 		}
 
-		results, _ := store.Search(q)
+		results, _ := store.Search(queryOptionsFromFlags(q))
 		if outputJSON {
 			fmt.Println(jsonizer(results))
 			return
 		}
 
-		playlistHandler(cmd, results)
+		playlistHandler(store, cmd, results)
 		return
 	}
 
 	interactiveLoop(store)
 }
 
+// ensureLibrary registers path as a Library named name the first time it's
+// scanned and returns its id on every subsequent run, matching on path
+// alone so a library's registered name doesn't need to match across runs.
+func ensureLibrary(store Datastore, name, path string) int64 {
+	libs, err := store.ListLibraries()
+	if err == nil {
+		for _, l := range libs {
+			if l.Path == path {
+				return l.ID
+			}
+		}
+	}
+	id, err := store.AddLibrary(name, path)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// ensureDefaultLibrary is ensureLibrary for the single -location CLI flow,
+// so a plain invocation gets consistent library-scoped indexing without
+// the user having to manage libraries explicitly (that's what --library,
+// via resolveLibraries, gives you).
+func ensureDefaultLibrary(store Datastore, location string) int64 {
+	return ensureLibrary(store, "default", location)
+}
+
+// resolveLibraries turns the --library flags (or, absent those, the
+// -location flag) into registered Libraries, fetching each one's current
+// LastScanAt so runLibraryCommands can freshen against it instead of the
+// database file's own mtime.
+func resolveLibraries(store Datastore, location string) []Library {
+	ids := make(map[int64]bool)
+
+	if len(libraryFlags) == 0 {
+		ids[ensureDefaultLibrary(store, location)] = true
+	} else {
+		for _, spec := range libraryFlags {
+			name, path, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Printf("Ignoring malformed --library %q, expected \"name=path\"", spec)
+				continue
+			}
+			ids[ensureLibrary(store, name, truePath(path))] = true
+		}
+	}
+
+	all, err := store.ListLibraries()
+	if err != nil {
+		return nil
+	}
+	var libraries []Library
+	for _, l := range all {
+		if ids[l.ID] {
+			libraries = append(libraries, l)
+		}
+	}
+	return libraries
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
@@ -223,7 +493,7 @@ func importSQLiteToBleve(sqlitePath string, bleveStore Datastore) error {
 	}
 	
 	// Get all data
-	allMedia, err := src.Search("")
+	allMedia, err := SearchString(src, "")
 	if err != nil {
 		return err
 	}
@@ -244,7 +514,7 @@ func importSQLiteToBleve(sqlitePath string, bleveStore Datastore) error {
 			batchPtrs = append(batchPtrs, &allMedia[j])
 		}
 		
-		if err := bleveStore.IndexMediaBatch(batchPtrs); err != nil {
+		if err := bleveStore.IndexMediaBatch(batchPtrs, 0); err != nil {
 			return err
 		}
 	}
@@ -285,35 +555,73 @@ func parseMediaFile(path string) *Media {
 		album = "unknown album"
 	}
 
-	genre := m.Genre()
-	if genre == "" {
-		genre = "unknown genre"
+	genres := SplitTagValue(m.Genre())
+	if len(genres) == 0 {
+		genres = []string{"unknown genre"}
 	}
 
 	if artist == "" {
 		artist = "unknown artist"
 	}
 
+	sortTitle := rawTagString(m, "TSOT", "TITLESORT")
+	sortArtist := rawTagString(m, "TSOP", "ARTISTSORT")
+	sortAlbum := rawTagString(m, "TSOA", "ALBUMSORT")
+
+	mbid, mbidAlbum, mbidArtist, mbidAlbumArtist, mbidReleaseGroup := musicBrainzIDs(m)
+	extraTags := extractExtraTags(m)
+
 	return &Media{
 		Title:       title,
 		Artist:      artist,
 		Album:       album,
 		TrackNumber: track,
 		DiscNumber:  disc,
-		Genre:       genre,
+		Genres:      genres,
 		Path:        path,
+
+		SortTitle:  sortTitle,
+		SortArtist: sortArtist,
+		SortAlbum:  sortAlbum,
+
+		OrderArtistName: NormalizeOrderName(artist),
+		OrderAlbumName:  NormalizeOrderName(album),
+
+		MBID:             mbid,
+		MBIDAlbum:        mbidAlbum,
+		MBIDArtist:       mbidArtist,
+		MBIDAlbumArtist:  mbidAlbumArtist,
+		MBIDReleaseGroup: mbidReleaseGroup,
+
+		Tags: extraTags,
 	}
 }
 
-func indexMedia(store Datastore, root string, isFreshen bool) {
-	// Need mtime check?
-	// Datastore interface doesn't expose raw path checks easily without query.
-	// We can use GetAllPaths.
-	
+// rawTagString looks up the first matching key in a file's raw tag frames
+// (ID3v2 frame IDs like "TSOT", or the Vorbis-comment equivalents), for
+// metadata that dhowden/tag doesn't expose through its typed accessors.
+func rawTagString(m tag.Metadata, keys ...string) string {
+	raw := m.Raw()
+	for _, key := range keys {
+		if v, ok := raw[key]; ok {
+			if s, ok := v.(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// indexMedia walks root looking for media files and sends them through
+// parseMediaFile to store.IndexMediaBatch, scoped to libraryID. When
+// isFreshen is set, only files modified after lastScan (that library's
+// last recorded scan time, from Datastore.ListLibraries) are reindexed;
+// a zero lastScan means "never scanned", so everything qualifies.
+func indexMedia(store Datastore, root string, isFreshen bool, libraryID int64, lastScan time.Time) {
 	var existingPaths map[string]bool
 	if isFreshen {
 		existingPaths = make(map[string]bool)
-		paths, _ := store.GetAllPaths()
+		paths, _ := store.GetAllPaths(libraryID)
 		for _, p := range paths {
 			existingPaths[p] = true
 		}
@@ -335,26 +643,10 @@ func indexMedia(store Datastore, root string, isFreshen bool) {
 			
 			ext := strings.ToLower(filepath.Ext(path))
 			if ext == ".mp3" || ext == ".m4a" || ext == ".ogg" || ext == ".oga" || ext == ".flac" {
-				// For freshen, we want to update if it exists OR is new.
-				// The Python logic was: "if minMtime == 0 or entry.stat().st_mtime > minMtime".
-				// Here "minMtime" was db mtime.
-				// If we want to strictly follow "freshen updates existing entries", we should index it.
-				// If we want to only add NEW files, that's different.
-				// SMJ7 freshen: "search for new files ... AND update existing entries".
-				// So we basically scan everything? 
-				// The Python code: `file_getter = lambda p: get_media_files(p, min_mtime=db_mtime)`
-				// It ONLY yields files modified AFTER the DB was modified.
-				// So it relies on FS mtime vs DB file mtime.
-				
 				if isFreshen {
 					info, err := d.Info()
-					if err == nil {
-						// We need DB mtime.
-						// Use os.Stat(databasePath)
-						dbStat, dbErr := os.Stat(databasePath)
-						if dbErr == nil && info.ModTime().After(dbStat.ModTime()) {
-							filesChan <- path
-						}
+					if err == nil && info.ModTime().After(lastScan) {
+						filesChan <- path
 					}
 				} else {
 					filesChan <- path
@@ -397,7 +689,7 @@ func indexMedia(store Datastore, root string, isFreshen bool) {
 
 		write := func(b []*Media) {
 			if len(b) > 0 {
-				store.IndexMediaBatch(b)
+				store.IndexMediaBatch(b, libraryID)
 				processedCount += len(b)
 			}
 		}
@@ -414,6 +706,10 @@ func indexMedia(store Datastore, root string, isFreshen bool) {
 
 	wgWriter.Wait()
 
+	if libraryID != 0 {
+		store.UpdateLastScan(libraryID, time.Now())
+	}
+
 	adverb := "Parallely"
 	if forceSerial {
 		adverb = "Serially"
@@ -458,7 +754,7 @@ func jsonizer(results []Media) string {
 	return string(b)
 }
 
-func playlistHandler(cmd string, results []Media) {
+func playlistHandler(store Datastore, cmd string, results []Media) {
 	if len(results) == 0 {
 		fmt.Println("No results found.")
 		return
@@ -467,7 +763,7 @@ func playlistHandler(cmd string, results []Media) {
 	cmd = strings.ToLower(strings.TrimSpace(cmd))
 	if i, err := strconv.Atoi(cmd); err == nil {
 		if i > 0 && i <= len(results) {
-			play(results[i-1:])
+			play(store, results[i-1:])
 		} else {
 			fmt.Printf("Enter value from 1 to %d, try again.\n", len(results))
 		}
@@ -476,10 +772,10 @@ func playlistHandler(cmd string, results []Media) {
 
 	switch {
 	case cmd == "a" || cmd == "":
-		play(results)
+		play(store, results)
 	case cmd == "r":
 		rand.Seed(time.Now().UnixNano())
-		play([]Media{results[rand.Intn(len(results))]})
+		play(store, []Media{results[rand.Intn(len(results))]})
 	case cmd == "s":
 		rand.Seed(time.Now().UnixNano())
 		shuffled := make([]Media, len(results))
@@ -487,53 +783,150 @@ func playlistHandler(cmd string, results []Media) {
 		rand.Shuffle(len(shuffled), func(i, j int) {
 			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
 		})
-		play(shuffled)
+		play(store, shuffled)
 	default:
 		fmt.Println("Not a valid playlist command, try again.")
 	}
 }
 
-func play(results []Media) {
-	mplayer, err := exec.LookPath("mplayer")
-	if err != nil {
-		fmt.Println("Error: MPlayer not found in PATH.")
+// sharedPlayer is the process-wide player.Player; play() creates it
+// lazily on first use so invocations that never play audio (--serve,
+// --json, a plain scan) don't pay for decoder/output initialization.
+var sharedPlayer player.Player
+
+func play(store Datastore, results []Media) {
+	if sharedPlayer == nil {
+		p, err := player.New(playerKind)
+		if err != nil {
+			fmt.Printf("Error starting player: %v\n", err)
+			return
+		}
+		sharedPlayer = p
+	}
+	runPlaybackSession(store, sharedPlayer, results)
+}
+
+// runPlaybackSession plays results back to back through p, honoring
+// transport keys read from a raw-mode terminal: space to pause/resume,
+// n/p to skip to the next/previous track, [/] to seek back/forward 5s,
+// and q (or Ctrl-C) to stop. If stdin isn't a real terminal (e.g. piped
+// input), transport keys are unavailable but playback still runs to
+// completion, advancing on each track's EventTrackFinished.
+//
+// It also drives a scrobbleTracker off the same event loop, submitting a
+// listen once a track crosses scrobbleThreshold and, with --now-playing,
+// sending a heartbeat when one starts.
+func runPlaybackSession(store Datastore, p player.Player, results []Media) {
+	if len(results) == 0 {
 		return
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	defer signal.Stop(c)
+	toPlayerMedia := func(m Media) player.Media {
+		return player.Media{Title: m.Title, Artist: m.Artist, Album: m.Album, Path: m.Path}
+	}
 
-	for _, m := range results {
+	index := -1
+	paused := false
+	advance := func(delta int) {
+		next := index + delta
+		if next < 0 || next >= len(results) {
+			return
+		}
+		index = next
+		paused = false
+		m := results[index]
 		fmt.Printf("\n--> Playing \"%s\" off of \"%s\" by \"%s\" -->\n\n", m.Title, m.Album, m.Artist)
-		cmd := exec.Command(mplayer, m.Path)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		p.Stop()
+		if err := p.Play(toPlayerMedia(m)); err != nil {
+			fmt.Printf("Error starting playback: %v\n", err)
+		}
+	}
+
+	fmt.Println("Transport: space=pause/resume  n=next  p=prev  [/]=seek  q=stop")
 
-		err := cmd.Start()
+	tracker := newScrobbleTracker(store, func() time.Duration {
+		if d, ok := p.(interface{ Duration() time.Duration }); ok {
+			return d.Duration()
+		}
+		return 0
+	})
+	scrobbleTick := time.NewTicker(5 * time.Second)
+	defer scrobbleTick.Stop()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	// keysCh carries raw key bytes from the reader goroutine into the
+	// select loop below, which is the only place index/paused are ever
+	// mutated. Handling transport keys directly in the reader goroutine
+	// would race it against the same loop's EventTrackFinished handling
+	// (e.g. 'n' pressed right as a track finishes racing two advance()
+	// calls against index).
+	keysCh := make(chan byte)
+	keysDone := make(chan struct{})
+	go func() {
+		defer close(keysDone)
+		fd := int(os.Stdin.Fd())
+		old, err := term.MakeRaw(fd)
 		if err != nil {
-			fmt.Printf("Error starting mplayer: %v\n", err)
-			continue
+			return
 		}
+		defer term.Restore(fd, old)
 
-		done := make(chan error, 1)
-		go func() {
-			done <- cmd.Wait()
-		}()
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				return
+			}
+			keysCh <- buf[0]
+		}
+	}()
+
+	advance(1)
 
+	for {
 		select {
-		case <-c:
-			fmt.Println("\nSkipping...")
-			<-done
-			return 
-		case err := <-done:
-			time.Sleep(250 * time.Millisecond)
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					_ = exitErr
+		case ev, ok := <-p.Events():
+			if !ok {
+				return
+			}
+			tracker.HandleEvent(ev)
+			if ev.Type == player.EventTrackFinished {
+				if index >= len(results)-1 {
 					return
 				}
+				advance(1)
 			}
+		case key := <-keysCh:
+			switch key {
+			case ' ':
+				if paused {
+					p.Resume()
+				} else {
+					p.Pause()
+				}
+				paused = !paused
+			case 'n':
+				advance(1)
+			case 'p':
+				advance(-1)
+			case '[':
+				p.Seek(-5 * time.Second)
+			case ']':
+				p.Seek(5 * time.Second)
+			case 'q', 3:
+				p.Stop()
+				return
+			}
+		case <-scrobbleTick.C:
+			tracker.Tick()
+		case <-keysDone:
+			// No terminal (or stdin closed): keep playing without keys.
+			keysDone = nil
+		case <-sigCh:
+			p.Stop()
+			return
 		}
 	}
 }
@@ -552,7 +945,7 @@ func interactiveLoop(store Datastore) {
 			break
 		}
 		input := scanner.Text()
-		results, _ := store.Search(input)
+		results, _ := SearchString(store, input)
 
 		if len(results) == 0 {
 			fmt.Println("No results found.")
@@ -560,7 +953,7 @@ func interactiveLoop(store Datastore) {
 		}
 
 		if len(results) == 1 {
-			play(results)
+			play(store, results)
 			continue
 		}
 
@@ -589,7 +982,7 @@ func interactiveLoop(store Datastore) {
 			break
 		}
 		choice := scanner.Text()
-		playlistHandler(choice, results)
+		playlistHandler(store, choice, results)
 	}
 }
 
@@ -621,6 +1014,9 @@ unlike-type parameters will be logically ANDed together.
 @<some string>                      - Search for artists matching the string
 #<some string>                      - Search for albums matching the string
 $<some string>                      - Search for tracks matching the string
+^<some string>                      - Search for a MusicBrainz id (track, album, artist, or release group)
+%<tag>:<some string>                 - Search a rich tag (composer, conductor, mood, bpm, compilation,
+                                       disc_subtitle, comment, ...) for a matching value
 <some string>                       - Search for artists, albums, or tracks matching the string
 
 ## Combinations
@@ -661,10 +1057,62 @@ s                                   - Play all matching songs, shuffled
 ./smj-go -q "@rolling stones, #greatest; a" - Plays all songs matching the query
 ./smj-go -q "@decemberists, #live; s"       - Plays all songs matching the query, in a random order
 
+# Playback
+
+Playback is decoded and output in-process by default (--player=embedded),
+so no external player binary is required; --player=mpv shells out to mpv
+over its JSON IPC socket instead, for its broader format support. While
+playing, transport keys are read from the terminal: space to pause or
+resume, n/p to skip to the next/previous track, [ and ] to seek back or
+forward 5 seconds, and q to stop.
+
 # Bleve Backend Features
 
 If using the experimental Bleve backend, you can also use standard search queries:
 
 title:love~2                       - Fuzzy match title for "love" with edit distance 2
 +artist:queen -title:live          - Must be Queen, must not be "live"
+
+# MusicBrainz ids
+
+./smj-go use_mbzid                  - Backfill MusicBrainz ids for entries whose files have them but
+                                       the database doesn't yet, after a dry-run confirmation. Once an
+                                       entry has them, artist/album grouping (e.g. getArtists,
+                                       getAlbumList2) keys on the MBID instead of the name, so two
+                                       artists sharing a name stay separate and a live/studio album pair
+                                       sharing a title doesn't merge.
+
+# Rich Tags
+
+Beyond the fixed title/artist/album/genre fields, smj-go reads a handful of
+additional tags when a file's own tags carry them: composer, conductor,
+mood, bpm, compilation, disc_subtitle, and comment. Query them with the
+"%" prefix:
+
+%composer:bach                      - Match entries with a composer tag containing "bach"
+%mood:calm, @eno                    - Calm-mood tracks by artists matching "eno"
+
+# Voice Control
+
+When running with --serve, POST /intent accepts a small JSON body
+{"intent": "...", "slots": {...}} for wiring smj-go into an Alexa skill or
+Home Assistant's media_player without glue code. Supported intents:
+StartPlay, StartPlayAlbumOrTitle, ResumePlay, Shuffle, Next. The response
+is a resolved JSON playlist of stream URLs the skill can enqueue.
+
+# Scrobbling
+
+Playback is reported to ListenBrainz and/or Last.fm as a "listen" once a
+track plays past half its length or 4 minutes, whichever comes first;
+--now-playing also sends a ListenBrainz heartbeat as soon as a track
+starts. Run the following once to connect a ListenBrainz account:
+
+./smj-go auth listenbrainz          - Prompts for a ListenBrainz user token, validates it, and
+                                       stores it for future playback sessions to scrobble against.
+
+Last.fm scrobbling reuses the same settings table (listenbrainz_token,
+lastfm_session_key, lastfm_api_key, lastfm_api_secret) but has no
+equivalent interactive flow here; its session key has to come from
+Last.fm's own auth.getSession handshake. Listens that can't reach any
+configured service (e.g. offline) are queued and retried on the next run.
 `
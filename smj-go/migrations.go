@@ -0,0 +1,72 @@
+//go:build cgo
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// migration is a single versioned schema change, applied in order by version.
+type migration struct {
+	version int
+	name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// migrations holds every registered migration, keyed by ascending version.
+// Individual files register their steps from an init() func so schema
+// evolution stays next to the code that depends on it.
+var migrations []migration
+
+func registerMigration(version int, name string, up, down func(tx *sql.Tx) error) {
+	migrations = append(migrations, migration{version: version, name: name, Up: up, Down: down})
+}
+
+// runMigrations brings db up to the latest registered schema version,
+// tracking progress in a schema_migrations table.
+func runMigrations(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations(version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool)
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "github.com/dhowden/tag"
+
+// MusicBrainz IDs are stored as TXXX frames (ID3v2) or plain field names
+// (Vorbis comments); dhowden/tag exposes both through Raw(), so each field
+// here tries the TXXX description first and the Vorbis-comment name second,
+// the same pattern rawTagString already uses for TSOT/TITLESORT and friends.
+var (
+	mbidTrackKeys        = []string{"MusicBrainz Track Id", "MUSICBRAINZ_TRACKID"}
+	mbidAlbumKeys        = []string{"MusicBrainz Album Id", "MUSICBRAINZ_ALBUMID"}
+	mbidArtistKeys       = []string{"MusicBrainz Artist Id", "MUSICBRAINZ_ARTISTID"}
+	mbidAlbumArtistKeys  = []string{"MusicBrainz Album Artist Id", "MUSICBRAINZ_ALBUMARTISTID"}
+	mbidReleaseGroupKeys = []string{"MusicBrainz Release Group Id", "MUSICBRAINZ_RELEASEGROUPID"}
+)
+
+// musicBrainzIDs extracts MusicBrainz identifiers from a file's raw tag
+// frames. Any identifier missing from the file comes back empty.
+func musicBrainzIDs(m tag.Metadata) (track, album, artist, albumArtist, releaseGroup string) {
+	return rawTagString(m, mbidTrackKeys...),
+		rawTagString(m, mbidAlbumKeys...),
+		rawTagString(m, mbidArtistKeys...),
+		rawTagString(m, mbidAlbumArtistKeys...),
+		rawTagString(m, mbidReleaseGroupKeys...)
+}
+
+// artistGroupKey returns a canonical identity for grouping Media by
+// artist, preferring the MusicBrainz artist id when present so two
+// distinct artists sharing a display name don't collapse into one entry.
+func artistGroupKey(m Media) string {
+	if m.MBIDArtist != "" {
+		return "mbid:" + m.MBIDArtist
+	}
+	return "name:" + NormalizeOrderName(m.Artist)
+}
+
+// albumGroupKey is artistGroupKey's album equivalent, falling back to a
+// name-normalized key scoped by artist so a live and a studio album
+// sharing a title don't merge when neither has an MBID.
+func albumGroupKey(m Media) string {
+	if m.MBIDAlbum != "" {
+		return "mbid:" + m.MBIDAlbum
+	}
+	return artistGroupKey(m) + "\x00" + NormalizeOrderName(m.Album)
+}
@@ -0,0 +1,217 @@
+package player
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/flac"
+	"github.com/faiface/beep/mp3"
+	"github.com/faiface/beep/speaker"
+	"github.com/faiface/beep/vorbis"
+	"github.com/faiface/beep/wav"
+)
+
+// embeddedPlayer decodes and plays audio in-process via beep/oto, so
+// smj-go no longer needs an external mplayer binary on PATH. Tracks are
+// queued and played back to back through the same beep.Speaker, so the
+// gap between tracks is whatever beep's own buffering introduces, not an
+// extra process start per track.
+type embeddedPlayer struct {
+	mu sync.Mutex
+
+	queue  []Media
+	events chan Event
+
+	ctrl     *beep.Ctrl
+	streamer beep.StreamSeekCloser
+	format   beep.Format
+
+	// initialized is the sample rate speaker.Init was last called with
+	// (0 before the first track). speaker.Init resets the whole output
+	// device, so calling it again on every track transition would both
+	// defeat gapless playback and risk leaking the previous stream;
+	// playNext only re-inits when the sample rate actually changes.
+	initialized beep.SampleRate
+}
+
+func newEmbeddedPlayer() (Player, error) {
+	return &embeddedPlayer{events: make(chan Event, 16)}, nil
+}
+
+func (p *embeddedPlayer) Events() <-chan Event { return p.events }
+
+func (p *embeddedPlayer) Play(m Media) error {
+	p.mu.Lock()
+	starting := len(p.queue) == 0 && p.streamer == nil
+	p.queue = append(p.queue, m)
+	p.mu.Unlock()
+
+	if starting {
+		return p.playNext()
+	}
+	return nil
+}
+
+// decode opens path and picks a beep decoder by file extension; smj-go's
+// library is assumed to hold the formats dhowden/tag already reads tags
+// from (mp3, flac, ogg/vorbis, wav).
+func decode(path string) (beep.StreamSeekCloser, beep.Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return mp3.Decode(f)
+	case ".flac":
+		return flac.Decode(f)
+	case ".ogg":
+		return vorbis.Decode(f)
+	case ".wav":
+		return wav.Decode(f)
+	default:
+		f.Close()
+		return nil, beep.Format{}, fmt.Errorf("player: unsupported format %q", filepath.Ext(path))
+	}
+}
+
+// playNext pops the head of the queue and starts it playing, chaining
+// into itself via speaker.Play's callback once the track finishes so the
+// queue keeps draining without the caller re-invoking Play.
+func (p *embeddedPlayer) playNext() error {
+	p.mu.Lock()
+	if len(p.queue) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	m := p.queue[0]
+	p.queue = p.queue[1:]
+	p.mu.Unlock()
+
+	streamer, format, err := decode(m.Path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	needsInit := p.initialized != format.SampleRate
+	p.mu.Unlock()
+	if needsInit {
+		if err := speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10)); err != nil {
+			streamer.Close()
+			return err
+		}
+	}
+
+	ctrl := &beep.Ctrl{Streamer: streamer}
+
+	p.mu.Lock()
+	p.streamer = streamer
+	p.format = format
+	p.ctrl = ctrl
+	p.initialized = format.SampleRate
+	p.mu.Unlock()
+
+	p.events <- Event{Type: EventTrackStarted, Media: m}
+
+	speaker.Play(beep.Seq(ctrl, beep.Callback(func() {
+		p.events <- Event{Type: EventTrackFinished, Media: m}
+		p.mu.Lock()
+		streamer.Close()
+		if p.streamer == streamer {
+			p.streamer = nil
+			p.ctrl = nil
+		}
+		p.mu.Unlock()
+		p.playNext()
+	})))
+	return nil
+}
+
+func (p *embeddedPlayer) Pause() {
+	p.mu.Lock()
+	ctrl := p.ctrl
+	p.mu.Unlock()
+	if ctrl == nil {
+		return
+	}
+	speaker.Lock()
+	ctrl.Paused = true
+	speaker.Unlock()
+}
+
+func (p *embeddedPlayer) Resume() {
+	p.mu.Lock()
+	ctrl := p.ctrl
+	p.mu.Unlock()
+	if ctrl == nil {
+		return
+	}
+	speaker.Lock()
+	ctrl.Paused = false
+	speaker.Unlock()
+}
+
+func (p *embeddedPlayer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = nil
+	if p.streamer != nil {
+		speaker.Lock()
+		p.streamer.Close()
+		speaker.Unlock()
+		p.streamer = nil
+		p.ctrl = nil
+	}
+}
+
+func (p *embeddedPlayer) Seek(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streamer == nil {
+		return
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+
+	pos := p.streamer.Position() + p.format.SampleRate.N(d)
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > p.streamer.Len() {
+		pos = p.streamer.Len()
+	}
+	p.streamer.Seek(pos)
+}
+
+func (p *embeddedPlayer) Position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streamer == nil {
+		return 0
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	return p.format.SampleRate.D(p.streamer.Position())
+}
+
+// Duration reports the current track's total length. It isn't part of
+// the Player interface itself (mpv's remote IPC doesn't expose it without
+// request/response correlation this client doesn't implement); callers
+// that want it type-assert for this optional interface instead (see
+// main.go's runPlaybackSession, which feeds it to the scrobbleTracker).
+func (p *embeddedPlayer) Duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streamer == nil {
+		return 0
+	}
+	speaker.Lock()
+	defer speaker.Unlock()
+	return p.format.SampleRate.D(p.streamer.Len())
+}
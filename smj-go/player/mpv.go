@@ -0,0 +1,151 @@
+package player
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// mpvPlayer drives an external mpv process over its JSON IPC socket (the
+// same approach navidrome offers as an alternative to its embedded
+// decoder), for users who'd rather rely on mpv's much broader format
+// support than smj-go's own beep-based decoder.
+type mpvPlayer struct {
+	mu sync.Mutex
+
+	cmd  *exec.Cmd
+	conn net.Conn
+
+	queue  []Media
+	events chan Event
+}
+
+func newMPVPlayer() (Player, error) {
+	if _, err := exec.LookPath("mpv"); err != nil {
+		return nil, fmt.Errorf("player: mpv not found in PATH: %w", err)
+	}
+
+	socketPath := fmt.Sprintf("%s/smj-go-mpv-%d.sock", os.TempDir(), os.Getpid())
+	cmd := exec.Command("mpv", "--idle", "--no-video", "--input-ipc-server="+socketPath)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("player: mpv IPC socket never came up: %w", err)
+	}
+
+	p := &mpvPlayer{cmd: cmd, conn: conn, events: make(chan Event, 16)}
+	go p.watchEndFile()
+	return p, nil
+}
+
+func (p *mpvPlayer) Events() <-chan Event { return p.events }
+
+func (p *mpvPlayer) command(args ...interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payload, err := json.Marshal(map[string]interface{}{"command": args})
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Write(append(payload, '\n'))
+	return err
+}
+
+func (p *mpvPlayer) Play(m Media) error {
+	p.mu.Lock()
+	starting := len(p.queue) == 0
+	p.queue = append(p.queue, m)
+	p.mu.Unlock()
+
+	if !starting {
+		return p.command("loadfile", m.Path, "append")
+	}
+	p.events <- Event{Type: EventTrackStarted, Media: m}
+	return p.command("loadfile", m.Path, "replace")
+}
+
+// watchEndFile reads mpv's IPC event stream and forwards natural "end-file"
+// finishes (the queue advancing) as EventTrackFinished/EventTrackStarted,
+// keeping smj-go's queue in sync with mpv's own --idle playlist. mpv sends
+// "end-file" for stops and errors too, distinguished by its reason field;
+// only reason "eof" is a genuine finish, so a Stop() call or a file that
+// fails to decode doesn't get reported (and later scrobbled, see
+// scrobble.go's unknown-duration fallback) as a completed listen.
+func (p *mpvPlayer) watchEndFile() {
+	scanner := bufio.NewScanner(p.conn)
+	for scanner.Scan() {
+		var msg struct {
+			Event  string `json:"event"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Event != "end-file" || msg.Reason != "eof" {
+			continue
+		}
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			continue
+		}
+		finished := p.queue[0]
+		p.queue = p.queue[1:]
+		next := Media{}
+		if len(p.queue) > 0 {
+			next = p.queue[0]
+		}
+		p.mu.Unlock()
+
+		p.events <- Event{Type: EventTrackFinished, Media: finished}
+		if next.Path != "" {
+			p.events <- Event{Type: EventTrackStarted, Media: next}
+		}
+	}
+}
+
+func (p *mpvPlayer) Pause() {
+	p.command("set_property", "pause", true)
+	p.events <- Event{Type: EventPaused}
+}
+
+func (p *mpvPlayer) Resume() {
+	p.command("set_property", "pause", false)
+	p.events <- Event{Type: EventResumed}
+}
+
+func (p *mpvPlayer) Stop() {
+	p.mu.Lock()
+	p.queue = nil
+	p.mu.Unlock()
+	p.command("stop")
+}
+
+func (p *mpvPlayer) Seek(d time.Duration) {
+	p.command("seek", d.Seconds(), "relative")
+}
+
+// Position isn't tracked locally; mpv's get_property IPC reply would need
+// a request/response correlation this minimal client doesn't implement,
+// so Position always reads 0 under the mpv backend.
+func (p *mpvPlayer) Position() time.Duration {
+	return 0
+}
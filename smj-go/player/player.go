@@ -0,0 +1,77 @@
+// Package player is smj-go's audio playback abstraction. It replaces the
+// old behavior of shelling out to an external mplayer binary (and failing
+// hard if it wasn't on PATH) with an in-process decoder by default, while
+// keeping an mpv-based backend available for users who'd rather rely on
+// mpv's broader format support.
+package player
+
+import "time"
+
+// Media is the subset of the main package's Media struct a Player needs
+// to play a track. It's a separate type (rather than importing the main
+// package's Media) so player has no import back to package main.
+type Media struct {
+	Title  string
+	Artist string
+	Album  string
+	Path   string
+}
+
+// EventType distinguishes the kinds of playback events a Player emits on
+// its Events channel.
+type EventType int
+
+const (
+	EventTrackStarted EventType = iota
+	EventTrackFinished
+	EventPaused
+	EventResumed
+)
+
+// Event is a single playback notification, carrying the Media it concerns
+// so callers (runPlaybackSession's transport keys, the scrobbleTracker) can
+// tell which track an event is about without separately tracking state.
+type Event struct {
+	Type  EventType
+	Media Media
+}
+
+// Player is the playback surface smj-go drives from interactiveLoop: a
+// gapless queue fed one track at a time via Play, transport controls, and
+// an Events channel for now-playing/scrobbling hooks.
+type Player interface {
+	// Play enqueues m. If nothing is currently playing, playback starts
+	// immediately; otherwise m plays once the current queue drains,
+	// gaplessly.
+	Play(m Media) error
+
+	Pause()
+	Resume()
+
+	// Stop halts playback and clears the queue.
+	Stop()
+
+	// Seek moves the current track's playback position by d (negative
+	// seeks backward); it's a no-op if nothing is playing.
+	Seek(d time.Duration)
+
+	// Position returns how far into the current track playback is.
+	Position() time.Duration
+
+	// Events delivers playback notifications as they happen; callers
+	// should drain it for as long as they hold the Player.
+	Events() <-chan Event
+}
+
+// New returns the Player backend named by kind: "embedded" (default, pure
+// Go decode/output via faiface/beep) or "mpv" (shells out to the mpv
+// binary over its JSON IPC socket, as navidrome optionally does). An
+// unrecognized kind falls back to "embedded".
+func New(kind string) (Player, error) {
+	switch kind {
+	case "mpv":
+		return newMPVPlayer()
+	default:
+		return newEmbeddedPlayer()
+	}
+}
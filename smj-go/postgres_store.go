@@ -0,0 +1,532 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore is a Datastore backed by PostgreSQL, for users who want to
+// externalize the catalog database (e.g. to share one library across
+// multiple smj-go instances). Selected via a "postgres://" DSN passed as
+// -database instead of a filesystem path.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// isPostgresDSN reports whether path looks like a Postgres connection
+// string rather than a filesystem path, so main can pick the backend
+// without an extra flag.
+func isPostgresDSN(path string) bool {
+	return strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://")
+}
+
+func (p *PostgresStore) Initialize(dsn string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	p.db = db
+
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS media(
+			id SERIAL PRIMARY KEY,
+			title TEXT,
+			artist TEXT,
+			album TEXT,
+			tracknumber INTEGER,
+			discnumber INTEGER,
+			genres TEXT[],
+			path TEXT UNIQUE,
+			sort_title TEXT NOT NULL DEFAULT '',
+			sort_artist TEXT NOT NULL DEFAULT '',
+			sort_album TEXT NOT NULL DEFAULT '',
+			order_artist_name TEXT NOT NULL DEFAULT '',
+			order_album_name TEXT NOT NULL DEFAULT '',
+			fulltext TSVECTOR GENERATED ALWAYS AS (
+				to_tsvector('simple', coalesce(title,'') || ' ' || coalesce(artist,'') || ' ' || coalesce(album,''))
+			) STORED
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_media_fulltext ON media USING GIN (fulltext);`,
+		`CREATE TABLE IF NOT EXISTS library(
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL UNIQUE,
+			last_scan_at TIMESTAMPTZ
+		);`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS library_id INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS mbid TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS mbid_album TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS mbid_artist TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS mbid_album_artist TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS mbid_release_group TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE media ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '{}'::jsonb;`,
+		`CREATE TABLE IF NOT EXISTS "user"(
+			username TEXT PRIMARY KEY,
+			password TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS setting(
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS pending_listen(
+			id SERIAL PRIMARY KEY,
+			artist TEXT NOT NULL,
+			title TEXT NOT NULL,
+			album TEXT NOT NULL,
+			played_at TIMESTAMPTZ NOT NULL
+		);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := p.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PostgresStore) Close() error {
+	if p.db != nil {
+		return p.db.Close()
+	}
+	return nil
+}
+
+func (p *PostgresStore) Clear() error {
+	_, err := p.db.Exec("DELETE FROM media")
+	return err
+}
+
+func (p *PostgresStore) AddLibrary(name, path string) (int64, error) {
+	var id int64
+	err := p.db.QueryRow("INSERT INTO library (name, path) VALUES ($1, $2) RETURNING id", name, path).Scan(&id)
+	return id, err
+}
+
+func (p *PostgresStore) RemoveLibrary(id int64) error {
+	if _, err := p.db.Exec("DELETE FROM media WHERE library_id = $1", id); err != nil {
+		return err
+	}
+	_, err := p.db.Exec("DELETE FROM library WHERE id = $1", id)
+	return err
+}
+
+func (p *PostgresStore) ListLibraries() ([]Library, error) {
+	rows, err := p.db.Query("SELECT id, name, path, COALESCE(last_scan_at, to_timestamp(0)) FROM library ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var libs []Library
+	for rows.Next() {
+		var l Library
+		if err := rows.Scan(&l.ID, &l.Name, &l.Path, &l.LastScanAt); err != nil {
+			return nil, err
+		}
+		libs = append(libs, l)
+	}
+	return libs, nil
+}
+
+// AddUser registers a user with password exactly as given, used by the
+// Subsonic API's token+salt auth (main.go's --add-user passes it through
+// subsonic.go's encryptUserPassword before calling AddUser).
+func (p *PostgresStore) AddUser(username, password string) error {
+	_, err := p.db.Exec(`INSERT INTO "user" (username, password) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET password = EXCLUDED.password`, username, password)
+	return err
+}
+
+// UserPassword returns the stored password for username, and whether the
+// user exists at all.
+func (p *PostgresStore) UserPassword(username string) (string, bool, error) {
+	var password string
+	err := p.db.QueryRow(`SELECT password FROM "user" WHERE username = $1`, username).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return password, true, nil
+}
+
+// GetSetting returns the stored value for key and whether it was set at all.
+func (p *PostgresStore) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := p.db.QueryRow("SELECT value FROM setting WHERE key = $1", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetSetting stores value under key, overwriting any previous value.
+func (p *PostgresStore) SetSetting(key, value string) error {
+	_, err := p.db.Exec(`INSERT INTO setting (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`, key, value)
+	return err
+}
+
+// QueuePendingListen records a listen that couldn't be submitted
+// immediately, for replay via PendingListens/RemovePendingListen.
+func (p *PostgresStore) QueuePendingListen(l PendingListen) error {
+	_, err := p.db.Exec("INSERT INTO pending_listen (artist, title, album, played_at) VALUES ($1, $2, $3, $4)",
+		l.Artist, l.Title, l.Album, l.PlayedAt)
+	return err
+}
+
+// PendingListens returns all listens queued by QueuePendingListen, oldest first.
+func (p *PostgresStore) PendingListens() ([]PendingListen, error) {
+	rows, err := p.db.Query("SELECT id, artist, title, album, played_at FROM pending_listen ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var listens []PendingListen
+	for rows.Next() {
+		var l PendingListen
+		if err := rows.Scan(&l.ID, &l.Artist, &l.Title, &l.Album, &l.PlayedAt); err != nil {
+			return nil, err
+		}
+		listens = append(listens, l)
+	}
+	return listens, nil
+}
+
+// RemovePendingListen deletes a queued listen once it's been successfully submitted.
+func (p *PostgresStore) RemovePendingListen(id int64) error {
+	_, err := p.db.Exec("DELETE FROM pending_listen WHERE id = $1", id)
+	return err
+}
+
+func (p *PostgresStore) IndexMediaBatch(batch []*Media, libraryID int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO media (title, artist, album, tracknumber, discnumber, genres, path, sort_title, sort_artist, sort_album, order_artist_name, order_album_name, library_id, mbid, mbid_album, mbid_artist, mbid_album_artist, mbid_release_group, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19::jsonb)
+		ON CONFLICT (path) DO UPDATE SET
+			title = EXCLUDED.title,
+			artist = EXCLUDED.artist,
+			album = EXCLUDED.album,
+			tracknumber = EXCLUDED.tracknumber,
+			discnumber = EXCLUDED.discnumber,
+			genres = EXCLUDED.genres,
+			sort_title = EXCLUDED.sort_title,
+			sort_artist = EXCLUDED.sort_artist,
+			sort_album = EXCLUDED.sort_album,
+			order_artist_name = EXCLUDED.order_artist_name,
+			order_album_name = EXCLUDED.order_album_name,
+			library_id = EXCLUDED.library_id,
+			mbid = EXCLUDED.mbid,
+			mbid_album = EXCLUDED.mbid_album,
+			mbid_artist = EXCLUDED.mbid_artist,
+			mbid_album_artist = EXCLUDED.mbid_album_artist,
+			mbid_release_group = EXCLUDED.mbid_release_group,
+			tags = EXCLUDED.tags`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, m := range batch {
+		if libraryID != 0 {
+			m.LibraryID = libraryID
+		}
+		orderArtist, orderAlbum := m.OrderArtistName, m.OrderAlbumName
+		if orderArtist == "" {
+			orderArtist = NormalizeOrderName(m.Artist)
+		}
+		if orderAlbum == "" {
+			orderAlbum = NormalizeOrderName(m.Album)
+		}
+		tagsJSON, err := json.Marshal(m.Tags)
+		if err != nil {
+			continue
+		}
+
+		if _, err := stmt.Exec(m.Title, m.Artist, m.Album, m.TrackNumber, m.DiscNumber, pq.Array(m.Genres), m.Path,
+			m.SortTitle, m.SortArtist, m.SortAlbum, orderArtist, orderAlbum, m.LibraryID,
+			m.MBID, m.MBIDAlbum, m.MBIDArtist, m.MBIDAlbumArtist, m.MBIDReleaseGroup, string(tagsJSON)); err != nil {
+			continue
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateLastScan records that libraryID was just scanned, so a future
+// --freshen run only looks at files modified since.
+func (p *PostgresStore) UpdateLastScan(libraryID int64, at time.Time) error {
+	_, err := p.db.Exec("UPDATE library SET last_scan_at = $1 WHERE id = $2", at, libraryID)
+	return err
+}
+
+func (p *PostgresStore) Count() (int, error) {
+	var count int
+	err := p.db.QueryRow("SELECT COUNT(*) FROM media").Scan(&count)
+	return count, err
+}
+
+func (p *PostgresStore) GetAllPaths(libraryID int64) ([]string, error) {
+	query := "SELECT path FROM media"
+	var args []interface{}
+	if libraryID != 0 {
+		query += " WHERE library_id = $1"
+		args = append(args, libraryID)
+	}
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// PathIndexed reports whether path is currently indexed, via a single
+// indexed lookup rather than GetAllPaths(0)'s full-table fetch.
+func (p *PostgresStore) PathIndexed(path string) (bool, error) {
+	var exists int
+	err := p.db.QueryRow("SELECT 1 FROM media WHERE path = $1 LIMIT 1", path).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *PostgresStore) RemoveStaleEntries(libraryID int64) (int, error) {
+	paths, err := p.GetAllPaths(libraryID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("DELETE FROM media WHERE path = $1")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	removed := 0
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			stmt.Exec(path)
+			removed++
+		}
+	}
+	err = tx.Commit()
+	return removed, err
+}
+
+// Tags returns the distinct values seen for name, each with the number of
+// songs carrying it. "genre" is backed by the dedicated genres TEXT[]
+// column; every other name is looked up in the tags JSONB bag.
+func (p *PostgresStore) Tags(name string) ([]TagCount, error) {
+	var rows *sql.Rows
+	var err error
+	if name == "genre" {
+		rows, err = p.db.Query(`
+			SELECT genre, COUNT(*) FROM media, UNNEST(genres) AS genre
+			GROUP BY genre ORDER BY genre`)
+	} else {
+		rows, err = p.db.Query(`
+			SELECT value, COUNT(*) FROM media, jsonb_array_elements_text(COALESCE(tags->$1, '[]'::jsonb)) AS value
+			GROUP BY value ORDER BY value`, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TagCount
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Value, &tc.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, tc)
+	}
+	return counts, nil
+}
+
+const pgMediaColumns = "title, artist, album, tracknumber, discnumber, genres, path, sort_title, sort_artist, sort_album, order_artist_name, order_album_name, library_id, mbid, mbid_album, mbid_artist, mbid_album_artist, mbid_release_group, tags"
+
+// pgSortMappings mirrors sqliteSortMappings for the Postgres backend.
+var pgSortMappings = map[string]string{
+	"artist":         "order_artist_name, order_album_name, discnumber, tracknumber",
+	"album":          "order_album_name, order_artist_name, discnumber, tracknumber",
+	"title":          "title",
+	"recently_added": "id",
+}
+
+// pgOrderByClause mirrors SQLiteStore's orderByClause: an explicit
+// opts.Sort wins, then a file's own sort tags when PreferSortTags is set,
+// otherwise the derived order name; opts.Order flips direction.
+func pgOrderByClause(opts QueryOptions) string {
+	clause, ok := pgSortMappings[opts.Sort]
+	if !ok {
+		if PreferSortTags {
+			clause = "COALESCE(NULLIF(sort_artist,''), order_artist_name), COALESCE(NULLIF(sort_album,''), order_album_name), discnumber, tracknumber"
+		} else {
+			clause = "order_artist_name, order_album_name, discnumber, tracknumber"
+		}
+	}
+	if strings.EqualFold(opts.Order, "desc") {
+		// Split on top-level commas only, so COALESCE(NULLIF(...), ...)
+		// terms stay whole.
+		var desc []string
+		depth, start := 0, 0
+		for i, r := range clause {
+			switch {
+			case r == '(':
+				depth++
+			case r == ')':
+				depth--
+			case r == ',' && depth == 0:
+				desc = append(desc, strings.TrimSpace(clause[start:i])+" DESC")
+				start = i + 1
+			}
+		}
+		desc = append(desc, strings.TrimSpace(clause[start:])+" DESC")
+		clause = strings.Join(desc, ", ")
+	}
+	return "ORDER BY " + clause
+}
+
+func (p *PostgresStore) Search(opts QueryOptions) ([]Media, error) {
+	filter := parseSMJ7(opts.Query)
+	builder := newSQLBuilder(func(n int) string { return fmt.Sprintf("$%d", n) })
+	sqlParts, args := builder.whereFromFilter(filter, 0)
+	// Postgres LIKE is case-sensitive; SMJ7 matching is case-insensitive.
+	for i := range sqlParts {
+		sqlParts[i] = strings.ReplaceAll(sqlParts[i], " LIKE ", " ILIKE ")
+	}
+
+	if len(filter.GenreParams) > 0 {
+		var subParts []string
+		for _, g := range filter.GenreParams {
+			n := len(args) + 1
+			subParts = append(subParts, fmt.Sprintf("EXISTS (SELECT 1 FROM UNNEST(genres) AS gv WHERE gv ILIKE %s)", fmt.Sprintf("$%d", n)))
+			args = append(args, "%"+g+"%")
+		}
+		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
+	}
+
+	for tagName, values := range filter.TagParams {
+		var subParts []string
+		for _, v := range values {
+			n := len(args) + 1
+			subParts = append(subParts, fmt.Sprintf("EXISTS (SELECT 1 FROM jsonb_array_elements_text(COALESCE(tags -> $%d, '[]'::jsonb)) AS tv WHERE tv ILIKE $%d)", n, n+1))
+			args = append(args, tagName, "%"+v+"%")
+		}
+		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
+	}
+
+	// Free-text (unprefixed) segments go through Postgres full-text
+	// search (tsvector/tsquery) instead of LIKE scans.
+	if len(filter.MultiParams) > 0 {
+		var subParts []string
+		for _, p := range filter.MultiParams {
+			n := len(args) + 1
+			subParts = append(subParts, fmt.Sprintf("fulltext @@ plainto_tsquery('simple', %s)", fmt.Sprintf("$%d", n)))
+			args = append(args, p)
+		}
+		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
+	}
+
+	for key, value := range opts.Filters {
+		switch key {
+		case "genre":
+			n := len(args) + 1
+			sqlParts = append(sqlParts, fmt.Sprintf("%s = ANY(genres)", fmt.Sprintf("$%d", n)))
+			args = append(args, value)
+		case "artist":
+			n := len(args) + 1
+			sqlParts = append(sqlParts, fmt.Sprintf("artist = $%d", n))
+			args = append(args, value)
+		case "album":
+			n := len(args) + 1
+			sqlParts = append(sqlParts, fmt.Sprintf("album = $%d", n))
+			args = append(args, value)
+		}
+	}
+
+	if opts.LibraryID != 0 {
+		n := len(args) + 1
+		sqlParts = append(sqlParts, fmt.Sprintf("library_id = $%d", n))
+		args = append(args, opts.LibraryID)
+	}
+
+	query := "SELECT " + pgMediaColumns + " FROM media"
+	if len(sqlParts) > 0 {
+		query += " WHERE " + strings.Join(sqlParts, " AND ")
+	}
+	query += " " + pgOrderByClause(opts)
+
+	if opts.Max > 0 {
+		query += fmt.Sprintf(" LIMIT %d", opts.Max)
+	}
+	if opts.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", opts.Offset)
+	}
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return p.scanRows(rows)
+}
+
+func (p *PostgresStore) scanRows(rows *sql.Rows) ([]Media, error) {
+	defer rows.Close()
+	var results []Media
+	for rows.Next() {
+		var m Media
+		var genres []string
+		var tagsJSON []byte
+		err := rows.Scan(&m.Title, &m.Artist, &m.Album, &m.TrackNumber, &m.DiscNumber, pq.Array(&genres), &m.Path,
+			&m.SortTitle, &m.SortArtist, &m.SortAlbum, &m.OrderArtistName, &m.OrderAlbumName, &m.LibraryID,
+			&m.MBID, &m.MBIDAlbum, &m.MBIDArtist, &m.MBIDAlbumArtist, &m.MBIDReleaseGroup, &tagsJSON)
+		if err != nil {
+			return nil, err
+		}
+		m.Genres = genres
+		if len(tagsJSON) > 0 {
+			json.Unmarshal(tagsJSON, &m.Tags)
+		}
+		results = append(results, m)
+	}
+	return results, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThatDevopsGuy/multimedia/smj-go/player"
+)
+
+const (
+	listenBrainzSubmitURL   = "https://api.listenbrainz.org/1/submit-listens"
+	listenBrainzValidateURL = "https://api.listenbrainz.org/1/validate-token"
+	lastFMAPIURL            = "https://ws.audioscrobbler.com/2.0/"
+
+	settingListenBrainzToken = "listenbrainz_token"
+	settingLastFMSessionKey  = "lastfm_session_key"
+	settingLastFMAPIKey      = "lastfm_api_key"
+	settingLastFMAPISecret   = "lastfm_api_secret"
+)
+
+// scrobbleThreshold is how far into a track playback must reach before it
+// counts as a listen, per ListenBrainz and Last.fm's shared rule: half
+// the track's duration, capped at 4 minutes. If duration is unknown (the
+// mpv backend doesn't report one), the 4-minute cap stands alone.
+func scrobbleThreshold(duration time.Duration) time.Duration {
+	const cap4m = 4 * time.Minute
+	if duration <= 0 {
+		return cap4m
+	}
+	if half := duration / 2; half < cap4m {
+		return half
+	}
+	return cap4m
+}
+
+// scrobbleTracker watches one player.Player's playback for a track that's
+// crossed scrobbleThreshold. It's fed events and ticks by the same loop
+// that owns Player.Events() (runPlaybackSession), rather than reading the
+// channel itself, since Events() only supports a single consumer.
+type scrobbleTracker struct {
+	store      Datastore
+	durationOf func() time.Duration
+
+	current   player.Media
+	startedAt time.Time
+	scrobbled bool
+}
+
+func newScrobbleTracker(store Datastore, durationOf func() time.Duration) *scrobbleTracker {
+	return &scrobbleTracker{store: store, durationOf: durationOf}
+}
+
+// HandleEvent updates tracking state for a playback event, sending a
+// now-playing heartbeat on EventTrackStarted when --now-playing is set.
+func (t *scrobbleTracker) HandleEvent(ev player.Event) {
+	switch ev.Type {
+	case player.EventTrackStarted:
+		t.current = ev.Media
+		t.startedAt = time.Now()
+		t.scrobbled = false
+		if nowPlaying {
+			go submitNowPlaying(t.store, t.current)
+		}
+	case player.EventTrackFinished:
+		// The mpv backend never reports a duration (durationOf() stays 0),
+		// which pins scrobbleThreshold at a flat 4-minute floor most
+		// tracks never reach before finishing naturally. Without this,
+		// such a track would finish, reset below, and silently never get
+		// scrobbled. Fall back to scrobbling on a clean finish whenever
+		// duration is unknown, since Tick had no way to catch it.
+		if t.current.Path != "" && !t.scrobbled && t.durationOf() <= 0 {
+			t.scrobbled = true
+			go submitListen(t.store, t.current, t.startedAt)
+		}
+		t.current = player.Media{}
+	}
+}
+
+// Tick submits a listen for the current track if it's crossed
+// scrobbleThreshold since it started, at most once per track.
+func (t *scrobbleTracker) Tick() {
+	if t.current.Path == "" || t.scrobbled {
+		return
+	}
+	if time.Since(t.startedAt) >= scrobbleThreshold(t.durationOf()) {
+		t.scrobbled = true
+		go submitListen(t.store, t.current, t.startedAt)
+	}
+}
+
+// submitListen sends m as a single listen to every scrobble service that
+// has credentials configured in store's settings, queuing it as a
+// PendingListen for replay on the next startup if none of them could be
+// reached.
+func submitListen(store Datastore, m player.Media, playedAt time.Time) {
+	submitted := false
+
+	if token, set, _ := store.GetSetting(settingListenBrainzToken); set {
+		if err := submitListenBrainz(token, m, playedAt, "single"); err != nil {
+			log.Printf("scrobble: ListenBrainz submission failed: %v", err)
+		} else {
+			submitted = true
+		}
+	}
+
+	if sessionKey, set, _ := store.GetSetting(settingLastFMSessionKey); set {
+		if err := scrobbleLastFM(store, sessionKey, m, playedAt); err != nil {
+			log.Printf("scrobble: Last.fm submission failed: %v", err)
+		} else {
+			submitted = true
+		}
+	}
+
+	if !submitted {
+		store.QueuePendingListen(PendingListen{Artist: m.Artist, Title: m.Title, Album: m.Album, PlayedAt: playedAt})
+	}
+}
+
+// submitNowPlaying sends a ListenBrainz "playing_now" heartbeat. Unlike
+// submitListen, a failed heartbeat isn't queued for retry: it's stale the
+// moment the next track starts, so there's nothing worth replaying.
+func submitNowPlaying(store Datastore, m player.Media) {
+	token, set, _ := store.GetSetting(settingListenBrainzToken)
+	if !set {
+		return
+	}
+	if err := submitListenBrainz(token, m, time.Time{}, "playing_now"); err != nil {
+		log.Printf("scrobble: ListenBrainz now-playing heartbeat failed: %v", err)
+	}
+}
+
+// replayPendingListens resubmits every listen queued by a prior run that
+// couldn't reach any scrobble service (e.g. offline), removing each from
+// store once it goes through.
+func replayPendingListens(store Datastore) {
+	pending, err := store.PendingListens()
+	if err != nil || len(pending) == 0 {
+		return
+	}
+
+	for _, l := range pending {
+		m := player.Media{Artist: l.Artist, Title: l.Title, Album: l.Album}
+
+		submitted := false
+		if token, set, _ := store.GetSetting(settingListenBrainzToken); set {
+			if err := submitListenBrainz(token, m, l.PlayedAt, "single"); err == nil {
+				submitted = true
+			}
+		}
+		if sessionKey, set, _ := store.GetSetting(settingLastFMSessionKey); set {
+			if err := scrobbleLastFM(store, sessionKey, m, l.PlayedAt); err == nil {
+				submitted = true
+			}
+		}
+
+		if submitted {
+			store.RemovePendingListen(l.ID)
+		}
+	}
+}
+
+type listenBrainzPayload struct {
+	ListenType string              `json:"listen_type"`
+	Payload    []listenBrainzEvent `json:"payload"`
+}
+
+type listenBrainzEvent struct {
+	ListenedAt    int64             `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzTrack `json:"track_metadata"`
+}
+
+type listenBrainzTrack struct {
+	ArtistName  string `json:"artist_name"`
+	TrackName   string `json:"track_name"`
+	ReleaseName string `json:"release_name,omitempty"`
+}
+
+// submitListenBrainz POSTs m to ListenBrainz's /1/submit-listens as
+// either a "single" listen (listenType "single", carrying listened_at)
+// or a "playing_now" heartbeat (no listened_at, per ListenBrainz's spec).
+func submitListenBrainz(token string, m player.Media, playedAt time.Time, listenType string) error {
+	event := listenBrainzEvent{
+		TrackMetadata: listenBrainzTrack{
+			ArtistName:  m.Artist,
+			TrackName:   m.Title,
+			ReleaseName: m.Album,
+		},
+	}
+	if listenType != "playing_now" {
+		event.ListenedAt = playedAt.Unix()
+	}
+
+	body, err := json.Marshal(listenBrainzPayload{ListenType: listenType, Payload: []listenBrainzEvent{event}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, listenBrainzSubmitURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("listenbrainz: %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// validateListenBrainzToken checks token against /1/validate-token, used
+// by the "smj-go auth listenbrainz" flow before storing it.
+func validateListenBrainzToken(token string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, listenBrainzValidateURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Valid, nil
+}
+
+// scrobbleLastFM POSTs m to Last.fm's track.scrobble, signed per their
+// API's method signature scheme. Last.fm's own session-key handshake
+// (auth.getToken/auth.getSession) isn't implemented here: sessionKey,
+// like settingLastFMAPIKey/settingLastFMAPISecret, is expected to already
+// be configured via settings, since "smj-go auth listenbrainz" is the
+// only interactive auth flow this request asked for.
+func scrobbleLastFM(store Datastore, sessionKey string, m player.Media, playedAt time.Time) error {
+	apiKey, _, _ := store.GetSetting(settingLastFMAPIKey)
+	apiSecret, _, _ := store.GetSetting(settingLastFMAPISecret)
+	if apiKey == "" || apiSecret == "" {
+		return fmt.Errorf("lastfm: %s and %s must be configured alongside %s", settingLastFMAPIKey, settingLastFMAPISecret, settingLastFMSessionKey)
+	}
+
+	params := map[string]string{
+		"method":    "track.scrobble",
+		"api_key":   apiKey,
+		"sk":        sessionKey,
+		"artist":    m.Artist,
+		"track":     m.Title,
+		"album":     m.Album,
+		"timestamp": strconv.FormatInt(playedAt.Unix(), 10),
+	}
+	params["api_sig"] = lastFMSignature(params, apiSecret)
+	params["format"] = "json"
+
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+
+	resp, err := http.PostForm(lastFMAPIURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("lastfm: %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// lastFMSignature implements Last.fm's API signature scheme: every
+// parameter except format/callback, sorted by key, concatenated as
+// "keyvaluekeyvalue...", with the shared secret appended, then MD5'd.
+func lastFMSignature(params map[string]string, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k == "format" || k == "callback" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteString(params[k])
+	}
+	sb.WriteString(secret)
+
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// runAuthListenBrainz is the `smj-go auth listenbrainz` subcommand: it
+// prompts for a user token, validates it via /1/validate-token, and
+// stores it in the settings table submitListenBrainz reads from at
+// playback time.
+func runAuthListenBrainz() {
+	if !isPostgresDSN(databasePath) {
+		databasePath = truePath(databasePath)
+	}
+
+	var store Datastore
+	blevePath := strings.TrimSuffix(databasePath, ".sqlite") + ".bleve"
+	switch {
+	case isPostgresDSN(databasePath):
+		store = &PostgresStore{}
+	case fileExists(blevePath):
+		store = &BleveStore{}
+		databasePath = blevePath
+	default:
+		store = &SQLiteStore{}
+	}
+	if err := store.Initialize(databasePath); err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	fmt.Print("ListenBrainz user token (from https://listenbrainz.org/settings/): ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		return
+	}
+	token := strings.TrimSpace(scanner.Text())
+
+	valid, err := validateListenBrainzToken(token)
+	if err != nil {
+		log.Fatalf("auth listenbrainz: couldn't validate token: %v", err)
+	}
+	if !valid {
+		fmt.Println("auth listenbrainz: token rejected by ListenBrainz, not stored.")
+		return
+	}
+
+	if err := store.SetSetting(settingListenBrainzToken, token); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("auth listenbrainz: token stored.")
+}
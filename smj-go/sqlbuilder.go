@@ -0,0 +1,111 @@
+package main
+
+import "strings"
+
+// sqlBuilder translates SMJ7-style query strings into a parameterized
+// WHERE clause. It's shared between SQLiteStore and PostgresStore so the
+// two backends don't have to keep their own copies of the same parsing
+// logic in sync; each backend still owns how it turns a parsed genre
+// filter into SQL, since that differs with the underlying schema.
+type sqlBuilder struct {
+	// placeholder renders the n'th (1-based) bind parameter for the
+	// target driver, e.g. "?" for SQLite or "$3" for Postgres.
+	placeholder func(n int) string
+}
+
+func newSQLBuilder(placeholder func(n int) string) *sqlBuilder {
+	return &sqlBuilder{placeholder: placeholder}
+}
+
+// smj7Filter is the parsed form of an SMJ7 query string, split out by
+// field prefix. GenreParams and TagParams are left for the caller to
+// translate, since SQLiteStore and PostgresStore index genres and rich
+// tags differently.
+type smj7Filter struct {
+	GenreParams  []string
+	ArtistParams []string
+	AlbumParams  []string
+	TitleParams  []string
+	MBIDParams   []string
+	// TagParams holds parsed "%tagname:value" selectors, keyed by tag name
+	// (e.g. "composer") with one or more values to match.
+	TagParams   map[string][]string
+	MultiParams []string
+}
+
+func parseSMJ7(input string) smj7Filter {
+	var f smj7Filter
+	for _, word := range strings.Split(input, ",") {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(word, "!"):
+			f.GenreParams = append(f.GenreParams, word[1:])
+		case strings.HasPrefix(word, "@"):
+			f.ArtistParams = append(f.ArtistParams, word[1:])
+		case strings.HasPrefix(word, "#"):
+			f.AlbumParams = append(f.AlbumParams, word[1:])
+		case strings.HasPrefix(word, "$"):
+			f.TitleParams = append(f.TitleParams, word[1:])
+		case strings.HasPrefix(word, "^"):
+			f.MBIDParams = append(f.MBIDParams, word[1:])
+		case strings.HasPrefix(word, "%"):
+			name, value, ok := strings.Cut(word[1:], ":")
+			if !ok {
+				break
+			}
+			if f.TagParams == nil {
+				f.TagParams = make(map[string][]string)
+			}
+			f.TagParams[name] = append(f.TagParams[name], value)
+		default:
+			f.MultiParams = append(f.MultiParams, word)
+		}
+	}
+	return f
+}
+
+// whereFromFilter builds the artist/album/title/MBID portion of the WHERE
+// clause starting bind parameters at argOffset+1, returning the SQL
+// fragments and the args to bind in order. Genre, rich-tag (TagParams),
+// and free-text (MultiParams) filters are left on the filter for the
+// caller to translate, since those differ by backend (tag-table join vs
+// JSONB array lookup; FTS5 MATCH vs tsquery).
+func (b *sqlBuilder) whereFromFilter(f smj7Filter, argOffset int) (parts []string, args []interface{}) {
+	n := argOffset
+
+	addOrGroup := func(params []string, column string) {
+		if len(params) == 0 {
+			return
+		}
+		var subParts []string
+		for _, p := range params {
+			n++
+			subParts = append(subParts, column+" LIKE "+b.placeholder(n))
+			args = append(args, "%"+p+"%")
+		}
+		parts = append(parts, "("+strings.Join(subParts, " OR ")+")")
+	}
+
+	addOrGroup(f.ArtistParams, "artist")
+	addOrGroup(f.AlbumParams, "album")
+	addOrGroup(f.TitleParams, "title")
+
+	if len(f.MBIDParams) > 0 {
+		var subParts []string
+		for _, p := range f.MBIDParams {
+			var cols []string
+			for _, col := range []string{"mbid", "mbid_album", "mbid_artist", "mbid_album_artist", "mbid_release_group"} {
+				n++
+				cols = append(cols, col+" LIKE "+b.placeholder(n))
+				args = append(args, "%"+p+"%")
+			}
+			subParts = append(subParts, "("+strings.Join(cols, " OR ")+")")
+		}
+		parts = append(parts, "("+strings.Join(subParts, " OR ")+")")
+	}
+
+	return parts, args
+}
@@ -4,12 +4,272 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+func init() {
+	registerMigration(1, "create media table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS media(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT,
+			artist TEXT,
+			album TEXT,
+			tracknumber INTEGER,
+			discnumber INTEGER,
+			path TEXT UNIQUE
+		);`)
+		return err
+	}, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DROP TABLE media;`)
+		return err
+	})
+
+	registerMigration(2, "create tag and item_tags tables", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS tag(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			UNIQUE(name, value)
+		);`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS item_tags(
+			item_id INTEGER NOT NULL,
+			tag_name TEXT NOT NULL,
+			tag_id INTEGER NOT NULL,
+			UNIQUE(item_id, tag_id)
+		);`)
+		return err
+	}, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DROP TABLE item_tags;`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DROP TABLE tag;`)
+		return err
+	})
+
+	registerMigration(3, "index item_tags by tag_name", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_item_tags_name ON item_tags(tag_name, item_id);`)
+		return err
+	}, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DROP INDEX idx_item_tags_name;`)
+		return err
+	})
+
+	registerMigration(4, "add sort tags and derived order names", func(tx *sql.Tx) error {
+		for _, col := range []string{
+			"sort_title TEXT NOT NULL DEFAULT ''", "sort_artist TEXT NOT NULL DEFAULT ''", "sort_album TEXT NOT NULL DEFAULT ''",
+			"order_artist_name TEXT NOT NULL DEFAULT ''", "order_album_name TEXT NOT NULL DEFAULT ''",
+		} {
+			if _, err := tx.Exec("ALTER TABLE media ADD COLUMN " + col); err != nil {
+				return err
+			}
+		}
+
+		// Backfill order_artist_name/order_album_name for rows indexed
+		// before this migration existed; new rows get them from
+		// IndexMediaBatch going forward.
+		rows, err := tx.Query("SELECT id, artist, album FROM media")
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id           int64
+			artist, album string
+		}
+		var toUpdate []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.artist, &r.album); err != nil {
+				rows.Close()
+				return err
+			}
+			toUpdate = append(toUpdate, r)
+		}
+		rows.Close()
+
+		stmt, err := tx.Prepare("UPDATE media SET order_artist_name = ?, order_album_name = ? WHERE id = ?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, r := range toUpdate {
+			if _, err := stmt.Exec(NormalizeOrderName(r.artist), NormalizeOrderName(r.album), r.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(tx *sql.Tx) error {
+		// SQLite can't drop columns before 3.35; leaving them is harmless.
+		return nil
+	})
+
+	// This migration needs mattn/go-sqlite3 built with the sqlite_fts5
+	// build tag (see its sqlite3_opt_fts5.go); without it, this Exec
+	// fails with "no such module: fts5". Build/install via the Makefile
+	// ("make build"/"make install"), which passes -tags sqlite_fts5.
+	registerMigration(5, "add FTS5 full-text index", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`ALTER TABLE media ADD COLUMN full_text TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS media_fts USING fts5(full_text, content='media', content_rowid='id')`); err != nil {
+			return err
+		}
+		// Keep media_fts in sync with media.full_text as rows change.
+		triggers := []string{
+			`CREATE TRIGGER IF NOT EXISTS media_ai AFTER INSERT ON media BEGIN
+				INSERT INTO media_fts(rowid, full_text) VALUES (new.id, new.full_text);
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS media_ad AFTER DELETE ON media BEGIN
+				INSERT INTO media_fts(media_fts, rowid, full_text) VALUES ('delete', old.id, old.full_text);
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS media_au AFTER UPDATE ON media BEGIN
+				INSERT INTO media_fts(media_fts, rowid, full_text) VALUES ('delete', old.id, old.full_text);
+				INSERT INTO media_fts(rowid, full_text) VALUES (new.id, new.full_text);
+			END;`,
+		}
+		for _, trg := range triggers {
+			if _, err := tx.Exec(trg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(tx *sql.Tx) error {
+		for _, stmt := range []string{
+			"DROP TRIGGER IF EXISTS media_au",
+			"DROP TRIGGER IF EXISTS media_ad",
+			"DROP TRIGGER IF EXISTS media_ai",
+			"DROP TABLE IF EXISTS media_fts",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	registerMigration(6, "add library table and media.library_id", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS library(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL UNIQUE,
+			last_scan_at TEXT NOT NULL DEFAULT ''
+		);`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`ALTER TABLE media ADD COLUMN library_id INTEGER NOT NULL DEFAULT 0`)
+		return err
+	}, func(tx *sql.Tx) error {
+		// SQLite can't drop columns before 3.35; leaving library_id is harmless.
+		_, err := tx.Exec(`DROP TABLE library;`)
+		return err
+	})
+
+	registerMigration(7, "create user table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS user(
+			username TEXT PRIMARY KEY,
+			password TEXT NOT NULL
+		);`)
+		return err
+	}, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DROP TABLE user;`)
+		return err
+	})
+
+	registerMigration(8, "add MusicBrainz id columns", func(tx *sql.Tx) error {
+		for _, col := range []string{
+			"mbid TEXT NOT NULL DEFAULT ''",
+			"mbid_album TEXT NOT NULL DEFAULT ''",
+			"mbid_artist TEXT NOT NULL DEFAULT ''",
+			"mbid_album_artist TEXT NOT NULL DEFAULT ''",
+			"mbid_release_group TEXT NOT NULL DEFAULT ''",
+		} {
+			if _, err := tx.Exec("ALTER TABLE media ADD COLUMN " + col); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(tx *sql.Tx) error {
+		// SQLite can't drop columns before 3.35; leaving them is harmless.
+		return nil
+	})
+
+	registerMigration(9, "add rich tag bag", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`ALTER TABLE media ADD COLUMN tags TEXT NOT NULL DEFAULT '{}'`)
+		return err
+	}, func(tx *sql.Tx) error {
+		// SQLite can't drop columns before 3.35; leaving it is harmless.
+		return nil
+	})
+
+	registerMigration(10, "create settings and pending_listens tables", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS setting(
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS pending_listen(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			artist TEXT NOT NULL,
+			title TEXT NOT NULL,
+			album TEXT NOT NULL,
+			played_at TEXT NOT NULL
+		);`)
+		return err
+	}, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DROP TABLE setting;`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DROP TABLE pending_listen;`)
+		return err
+	})
+}
+
+// ftsMatchQuery turns a free-text search segment into an FTS5 MATCH
+// expression, prefix-matching each word (FTS5 implicitly ANDs space
+// separated terms) so "roll sto" matches "Rolling Stones".
+func ftsMatchQuery(segment string) string {
+	words := strings.Fields(strings.ToLower(foldDiacritics(segment)))
+	for i, w := range words {
+		words[i] = w + "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// fullTextBlob computes the normalized, tokenized blob stored in
+// media.full_text and indexed by the media_fts FTS5 table: lowercased,
+// diacritic-folded tokens from title/artist/album/genres, deduplicated and
+// sorted so the same words always produce the same blob regardless of tag
+// order.
+func fullTextBlob(m *Media) string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(s string) {
+		for _, tok := range strings.Fields(strings.ToLower(foldDiacritics(s))) {
+			if !seen[tok] {
+				seen[tok] = true
+				tokens = append(tokens, tok)
+			}
+		}
+	}
+	add(m.Title)
+	add(m.Artist)
+	add(m.Album)
+	for _, g := range m.Genres {
+		add(g)
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
 type SQLiteStore struct {
 	db *sql.DB
 }
@@ -20,18 +280,13 @@ func (s *SQLiteStore) Initialize(path string) error {
 		return err
 	}
 	s.db = db
-
-	sqlStmt := `CREATE TABLE IF NOT EXISTS media(
-		title TEXT,
-		artist TEXT,
-		album TEXT,
-		tracknumber INTEGER,
-		discnumber INTEGER,
-		genre TEXT,
-		path TEXT UNIQUE
-	);`
-	_, err = s.db.Exec(sqlStmt)
-	return err
+	if err := runMigrations(s.db); err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return fmt.Errorf("sqlite3 driver was built without FTS5 support; rebuild with `go build -tags sqlite_fts5 ./...` (see the Makefile's \"build\"/\"install\" targets): %w", err)
+		}
+		return err
+	}
+	return nil
 }
 
 func (s *SQLiteStore) Close() error {
@@ -42,40 +297,274 @@ func (s *SQLiteStore) Close() error {
 }
 
 func (s *SQLiteStore) Clear() error {
+	if _, err := s.db.Exec("DELETE FROM item_tags"); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("DELETE FROM tag"); err != nil {
+		return err
+	}
 	_, err := s.db.Exec("DELETE FROM media")
 	return err
 }
 
-func (s *SQLiteStore) IndexMediaBatch(batch []*Media) error {
+// AddLibrary registers a new music root and returns its id.
+func (s *SQLiteStore) AddLibrary(name, path string) (int64, error) {
+	res, err := s.db.Exec("INSERT INTO library (name, path) VALUES (?, ?)", name, path)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// RemoveLibrary deletes a library registration and everything indexed
+// under it.
+func (s *SQLiteStore) RemoveLibrary(id int64) error {
+	if _, err := s.db.Exec("DELETE FROM media WHERE library_id = ?", id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM library WHERE id = ?", id)
+	return err
+}
+
+// ListLibraries returns all registered music roots.
+func (s *SQLiteStore) ListLibraries() ([]Library, error) {
+	rows, err := s.db.Query("SELECT id, name, path, last_scan_at FROM library ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var libs []Library
+	for rows.Next() {
+		var l Library
+		var lastScan string
+		if err := rows.Scan(&l.ID, &l.Name, &l.Path, &lastScan); err != nil {
+			return nil, err
+		}
+		if lastScan != "" {
+			l.LastScanAt, _ = time.Parse(time.RFC3339, lastScan)
+		}
+		libs = append(libs, l)
+	}
+	return libs, nil
+}
+
+// AddUser registers a user with password exactly as given, used by the
+// Subsonic API's token+salt auth (main.go's --add-user passes it through
+// subsonic.go's encryptUserPassword before calling AddUser).
+func (s *SQLiteStore) AddUser(username, password string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO user (username, password) VALUES (?, ?)", username, password)
+	return err
+}
+
+// UserPassword returns the stored password for username, and whether the
+// user exists at all.
+func (s *SQLiteStore) UserPassword(username string) (string, bool, error) {
+	var password string
+	err := s.db.QueryRow("SELECT password FROM user WHERE username = ?", username).Scan(&password)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return password, true, nil
+}
+
+// GetSetting returns the stored value for key and whether it was set at all.
+func (s *SQLiteStore) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM setting WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// SetSetting stores value under key, overwriting any previous value.
+func (s *SQLiteStore) SetSetting(key, value string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO setting (key, value) VALUES (?, ?)", key, value)
+	return err
+}
+
+// QueuePendingListen records a listen that couldn't be submitted
+// immediately, for replay via PendingListens/RemovePendingListen.
+func (s *SQLiteStore) QueuePendingListen(l PendingListen) error {
+	_, err := s.db.Exec("INSERT INTO pending_listen (artist, title, album, played_at) VALUES (?, ?, ?, ?)",
+		l.Artist, l.Title, l.Album, l.PlayedAt.Format(time.RFC3339))
+	return err
+}
+
+// PendingListens returns all listens queued by QueuePendingListen, oldest first.
+func (s *SQLiteStore) PendingListens() ([]PendingListen, error) {
+	rows, err := s.db.Query("SELECT id, artist, title, album, played_at FROM pending_listen ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var listens []PendingListen
+	for rows.Next() {
+		var l PendingListen
+		var playedAt string
+		if err := rows.Scan(&l.ID, &l.Artist, &l.Title, &l.Album, &playedAt); err != nil {
+			return nil, err
+		}
+		l.PlayedAt, _ = time.Parse(time.RFC3339, playedAt)
+		listens = append(listens, l)
+	}
+	return listens, nil
+}
+
+// RemovePendingListen deletes a queued listen once it's been successfully submitted.
+func (s *SQLiteStore) RemovePendingListen(id int64) error {
+	_, err := s.db.Exec("DELETE FROM pending_listen WHERE id = ?", id)
+	return err
+}
+
+// tagID returns the id of the (name, value) row in tag, inserting it if
+// it doesn't already exist.
+func (s *SQLiteStore) tagID(tx *sql.Tx, name, value string) (int64, error) {
+	if _, err := tx.Exec("INSERT OR IGNORE INTO tag (name, value) VALUES (?, ?)", name, value); err != nil {
+		return 0, err
+	}
+	var id int64
+	err := tx.QueryRow("SELECT id FROM tag WHERE name = ? AND value = ?", name, value).Scan(&id)
+	return id, err
+}
+
+func (s *SQLiteStore) IndexMediaBatch(batch []*Media, libraryID int64) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO media (title, artist, album, tracknumber, discnumber, genre, path) VALUES (?, ?, ?, ?, ?, ?, ?)")
+
+	// INSERT OR REPLACE would delete-then-reinsert any row whose path
+	// already exists, handing it a brand-new AUTOINCREMENT id and
+	// orphaning its old item_tags rows forever (they're cleaned up below
+	// by the *new* id, never the old one). Upsert in place instead, the
+	// same way postgres_store.go's ON CONFLICT ... DO UPDATE does, so a
+	// re-scanned file keeps its id and the item_tags re-sync below
+	// replaces its old rows.
+	mediaStmt, err := tx.Prepare(`INSERT INTO media
+		(title, artist, album, tracknumber, discnumber, path, sort_title, sort_artist, sort_album, order_artist_name, order_album_name, full_text, library_id, mbid, mbid_album, mbid_artist, mbid_album_artist, mbid_release_group, tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET
+			title = excluded.title,
+			artist = excluded.artist,
+			album = excluded.album,
+			tracknumber = excluded.tracknumber,
+			discnumber = excluded.discnumber,
+			sort_title = excluded.sort_title,
+			sort_artist = excluded.sort_artist,
+			sort_album = excluded.sort_album,
+			order_artist_name = excluded.order_artist_name,
+			order_album_name = excluded.order_album_name,
+			full_text = excluded.full_text,
+			library_id = excluded.library_id,
+			mbid = excluded.mbid,
+			mbid_album = excluded.mbid_album,
+			mbid_artist = excluded.mbid_artist,
+			mbid_album_artist = excluded.mbid_album_artist,
+			mbid_release_group = excluded.mbid_release_group,
+			tags = excluded.tags`)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	defer stmt.Close()
+	defer mediaStmt.Close()
+
+	// ON CONFLICT ... DO UPDATE runs an UPDATE under the hood, which
+	// doesn't advance last_insert_rowid(), so res.LastInsertId() can't be
+	// trusted to name the row we just wrote; look it up by path instead.
+	idStmt, err := tx.Prepare("SELECT id FROM media WHERE path = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer idStmt.Close()
 
 	for _, m := range batch {
-		_, err = stmt.Exec(m.Title, m.Artist, m.Album, m.TrackNumber, m.DiscNumber, m.Genre, m.Path)
+		if libraryID != 0 {
+			m.LibraryID = libraryID
+		}
+		orderArtist, orderAlbum := m.OrderArtistName, m.OrderAlbumName
+		if orderArtist == "" {
+			orderArtist = NormalizeOrderName(m.Artist)
+		}
+		if orderAlbum == "" {
+			orderAlbum = NormalizeOrderName(m.Album)
+		}
+		tagsJSON, err := json.Marshal(m.Tags)
 		if err != nil {
-			// Log but continue? Or fail batch?
-			// For now, logging externally isn't easy here, so we just continue
+			continue
+		}
+
+		if _, err := mediaStmt.Exec(m.Title, m.Artist, m.Album, m.TrackNumber, m.DiscNumber, m.Path,
+			m.SortTitle, m.SortArtist, m.SortAlbum, orderArtist, orderAlbum, fullTextBlob(m), m.LibraryID,
+			m.MBID, m.MBIDAlbum, m.MBIDArtist, m.MBIDAlbumArtist, m.MBIDReleaseGroup, string(tagsJSON)); err != nil {
+			continue
+		}
+		var itemID int64
+		if err := idStmt.QueryRow(m.Path).Scan(&itemID); err != nil {
+			continue
+		}
+
+		if _, err := tx.Exec("DELETE FROM item_tags WHERE item_id = ? AND tag_name = 'genre'", itemID); err != nil {
+			continue
+		}
+		for _, genre := range m.Genres {
+			tagID, err := s.tagID(tx, "genre", genre)
+			if err != nil {
+				continue
+			}
+			tx.Exec("INSERT OR IGNORE INTO item_tags (item_id, tag_name, tag_id) VALUES (?, 'genre', ?)", itemID, tagID)
+		}
+
+		// item_tags supports any tag_name (see migration 2); genre is
+		// handled above as its own dedicated field, so the rich tag bag
+		// only needs to re-sync everything else.
+		if _, err := tx.Exec("DELETE FROM item_tags WHERE item_id = ? AND tag_name != 'genre'", itemID); err != nil {
+			continue
+		}
+		for tagName, values := range m.Tags {
+			for _, value := range values {
+				tagID, err := s.tagID(tx, tagName, value)
+				if err != nil {
+					continue
+				}
+				tx.Exec("INSERT OR IGNORE INTO item_tags (item_id, tag_name, tag_id) VALUES (?, ?, ?)", itemID, tagName, tagID)
+			}
 		}
 	}
 	return tx.Commit()
 }
 
+// UpdateLastScan records that libraryID was just scanned, so a future
+// --freshen run only looks at files modified since.
+func (s *SQLiteStore) UpdateLastScan(libraryID int64, at time.Time) error {
+	_, err := s.db.Exec("UPDATE library SET last_scan_at = ? WHERE id = ?", at.UTC().Format(time.RFC3339), libraryID)
+	return err
+}
+
 func (s *SQLiteStore) Count() (int, error) {
 	var count int
 	err := s.db.QueryRow("SELECT COUNT(*) FROM media").Scan(&count)
 	return count, err
 }
 
-func (s *SQLiteStore) GetAllPaths() ([]string, error) {
-	rows, err := s.db.Query("SELECT path FROM media")
+func (s *SQLiteStore) GetAllPaths(libraryID int64) ([]string, error) {
+	query := "SELECT path FROM media"
+	var args []interface{}
+	if libraryID != 0 {
+		query += " WHERE library_id = ?"
+		args = append(args, libraryID)
+	}
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -91,8 +580,22 @@ func (s *SQLiteStore) GetAllPaths() ([]string, error) {
 	return paths, nil
 }
 
-func (s *SQLiteStore) RemoveStaleEntries() (int, error) {
-	paths, err := s.GetAllPaths()
+// PathIndexed reports whether path is currently indexed, via a single
+// indexed lookup rather than GetAllPaths(0)'s full-table fetch.
+func (s *SQLiteStore) PathIndexed(path string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow("SELECT 1 FROM media WHERE path = ? LIMIT 1", path).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLiteStore) RemoveStaleEntries(libraryID int64) (int, error) {
+	paths, err := s.GetAllPaths(libraryID)
 	if err != nil {
 		return 0, err
 	}
@@ -119,83 +622,163 @@ func (s *SQLiteStore) RemoveStaleEntries() (int, error) {
 	return removed, err
 }
 
-func (s *SQLiteStore) Search(input string) ([]Media, error) {
-	if input == "" {
-		rows, err := s.db.Query("SELECT title, artist, album, tracknumber, discnumber, genre, path FROM media ORDER BY artist, album, discnumber, tracknumber")
-		if err != nil {
+// Tags returns the distinct values seen for the given tag name (e.g.
+// "genre"), each with the number of songs carrying it.
+func (s *SQLiteStore) Tags(name string) ([]TagCount, error) {
+	rows, err := s.db.Query(`
+		SELECT tag.value, COUNT(DISTINCT item_tags.item_id)
+		FROM tag
+		JOIN item_tags ON item_tags.tag_id = tag.id
+		WHERE tag.name = ?
+		GROUP BY tag.value
+		ORDER BY tag.value`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TagCount
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Value, &tc.Count); err != nil {
 			return nil, err
 		}
-		return s.scanRows(rows)
+		counts = append(counts, tc)
 	}
+	return counts, nil
+}
 
-	var genreParams, artistParams, albumParams, titleParams, multiParams []string
-	for _, word := range strings.Split(input, ",") {
-		word = strings.TrimSpace(word)
-		if word == "" {
-			continue
-		}
-		if strings.HasPrefix(word, "!") {
-			genreParams = append(genreParams, word[1:])
-		} else if strings.HasPrefix(word, "@") {
-			artistParams = append(artistParams, word[1:])
-		} else if strings.HasPrefix(word, "#") {
-			albumParams = append(albumParams, word[1:])
-		} else if strings.HasPrefix(word, "$") {
-			titleParams = append(titleParams, word[1:])
+const mediaColumns = "id, title, artist, album, tracknumber, discnumber, path, sort_title, sort_artist, sort_album, order_artist_name, order_album_name, library_id, mbid, mbid_album, mbid_artist, mbid_album_artist, mbid_release_group, tags"
+
+// sqliteSortMappings maps QueryOptions.Sort values to ORDER BY clauses.
+// The empty/unrecognized key is the default artist/album/disc/track order,
+// switched between the derived order name and a file's own sort tags by
+// PreferSortTags (see orderByClause).
+var sqliteSortMappings = map[string]string{
+	"artist":          "order_artist_name, order_album_name, discnumber, tracknumber",
+	"album":           "order_album_name, order_artist_name, discnumber, tracknumber",
+	"title":           "title",
+	"recently_added":  "id",
+}
+
+// orderByClause returns the ORDER BY clause used for Search results,
+// honoring opts.Sort/opts.Order via sqliteSortMappings when set. When
+// PreferSortTags is set and no explicit sort was requested, a file's own
+// TSOP/TSOA sort tags win over the derived order name.
+func orderByClause(opts QueryOptions) string {
+	clause, ok := sqliteSortMappings[opts.Sort]
+	if !ok {
+		if PreferSortTags {
+			clause = "COALESCE(NULLIF(sort_artist,''), order_artist_name), COALESCE(NULLIF(sort_album,''), order_album_name), discnumber, tracknumber"
 		} else {
-			multiParams = append(multiParams, word)
+			clause = "order_artist_name, order_album_name, discnumber, tracknumber"
 		}
 	}
+	if strings.EqualFold(opts.Order, "desc") {
+		// Split on top-level commas only, so COALESCE(NULLIF(...), ...)
+		// terms stay whole.
+		var desc []string
+		depth, start := 0, 0
+		for i, r := range clause {
+			switch {
+			case r == '(':
+				depth++
+			case r == ')':
+				depth--
+			case r == ',' && depth == 0:
+				desc = append(desc, strings.TrimSpace(clause[start:i])+" DESC")
+				start = i + 1
+			}
+		}
+		desc = append(desc, strings.TrimSpace(clause[start:])+" DESC")
+		clause = strings.Join(desc, ", ")
+	}
+	return "ORDER BY " + clause
+}
 
-	var sqlParts []string
-	var args []interface{}
+// filterClause translates a single QueryOptions.Filters entry into a SQL
+// fragment + bind argument. Only filters this backend understands are
+// honored; unknown keys are silently ignored, mirroring how an unknown
+// "sort" value falls back to the default order.
+func filterClause(key string, value any) (string, interface{}, bool) {
+	switch key {
+	case "genre":
+		return "EXISTS (SELECT 1 FROM item_tags JOIN tag ON tag.id = item_tags.tag_id WHERE item_tags.item_id = media.id AND item_tags.tag_name = 'genre' AND tag.value = ?)", value, true
+	case "artist":
+		return "artist = ?", value, true
+	case "album":
+		return "album = ?", value, true
+	default:
+		return "", nil, false
+	}
+}
+
+func (s *SQLiteStore) Search(opts QueryOptions) ([]Media, error) {
+	filter := parseSMJ7(opts.Query)
+	builder := newSQLBuilder(func(int) string { return "?" })
+	sqlParts, args := builder.whereFromFilter(filter, 0)
 
-	if len(genreParams) > 0 {
+	if len(filter.GenreParams) > 0 {
 		var subParts []string
-		for _, p := range genreParams {
-			subParts = append(subParts, "genre LIKE ?")
+		for _, p := range filter.GenreParams {
+			subParts = append(subParts, "EXISTS (SELECT 1 FROM item_tags JOIN tag ON tag.id = item_tags.tag_id WHERE item_tags.item_id = media.id AND item_tags.tag_name = 'genre' AND tag.value LIKE ?)")
 			args = append(args, "%"+p+"%")
 		}
 		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
 	}
-	if len(artistParams) > 0 {
+
+	for tagName, values := range filter.TagParams {
 		var subParts []string
-		for _, p := range artistParams {
-			subParts = append(subParts, "artist LIKE ?")
-			args = append(args, "%"+p+"%")
+		for _, v := range values {
+			subParts = append(subParts, "EXISTS (SELECT 1 FROM item_tags JOIN tag ON tag.id = item_tags.tag_id WHERE item_tags.item_id = media.id AND item_tags.tag_name = ? AND tag.value LIKE ?)")
+			args = append(args, tagName, "%"+v+"%")
 		}
 		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
 	}
-	if len(albumParams) > 0 {
+
+	// Free-text (unprefixed) segments go through the FTS5 index instead of
+	// LIKE scans across artist/album/title. Each segment gets its own
+	// "id IN (subquery)" clause rather than a shared MATCH, since FTS5
+	// only allows one MATCH per virtual table reference per query.
+	if len(filter.MultiParams) > 0 {
 		var subParts []string
-		for _, p := range albumParams {
-			subParts = append(subParts, "album LIKE ?")
-			args = append(args, "%"+p+"%")
+		for _, p := range filter.MultiParams {
+			subParts = append(subParts, "media.id IN (SELECT rowid FROM media_fts WHERE media_fts MATCH ?)")
+			args = append(args, ftsMatchQuery(p))
 		}
 		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
 	}
-	if len(titleParams) > 0 {
-		var subParts []string
-		for _, p := range titleParams {
-			subParts = append(subParts, "title LIKE ?")
-			args = append(args, "%"+p+"%")
+
+	for key, value := range opts.Filters {
+		if clause, arg, ok := filterClause(key, value); ok {
+			sqlParts = append(sqlParts, clause)
+			args = append(args, arg)
 		}
-		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
 	}
-	if len(multiParams) > 0 {
-		var subParts []string
-		for _, p := range multiParams {
-			subParts = append(subParts, "(artist LIKE ? OR album LIKE ? OR title LIKE ?)")
-			args = append(args, "%"+p+"%", "%"+p+"%", "%"+p+"%")
-		}
-		sqlParts = append(sqlParts, "("+strings.Join(subParts, " OR ")+")")
+
+	if opts.LibraryID != 0 {
+		sqlParts = append(sqlParts, "media.library_id = ?")
+		args = append(args, opts.LibraryID)
 	}
 
-	query := "SELECT title, artist, album, tracknumber, discnumber, genre, path FROM media"
+	query := "SELECT " + mediaColumns + " FROM media"
 	if len(sqlParts) > 0 {
 		query += " WHERE " + strings.Join(sqlParts, " AND ")
 	}
-	query += " ORDER BY artist, album, discnumber, tracknumber"
+	query += " " + orderByClause(opts)
+
+	if opts.Max > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Max)
+		if opts.Offset > 0 {
+			query += " OFFSET ?"
+			args = append(args, opts.Offset)
+		}
+	} else if opts.Offset > 0 {
+		// SQLite requires a LIMIT to use OFFSET; -1 means "no limit".
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, opts.Offset)
+	}
 
 	rows, err := s.db.Query(query, args...)
 	if err != nil {
@@ -207,13 +790,52 @@ func (s *SQLiteStore) Search(input string) ([]Media, error) {
 func (s *SQLiteStore) scanRows(rows *sql.Rows) ([]Media, error) {
 	defer rows.Close()
 	var results []Media
+	var ids []int64
 	for rows.Next() {
 		var m Media
-		err := rows.Scan(&m.Title, &m.Artist, &m.Album, &m.TrackNumber, &m.DiscNumber, &m.Genre, &m.Path)
+		var id int64
+		var tagsJSON string
+		err := rows.Scan(&id, &m.Title, &m.Artist, &m.Album, &m.TrackNumber, &m.DiscNumber, &m.Path,
+			&m.SortTitle, &m.SortArtist, &m.SortAlbum, &m.OrderArtistName, &m.OrderAlbumName, &m.LibraryID,
+			&m.MBID, &m.MBIDAlbum, &m.MBIDArtist, &m.MBIDAlbumArtist, &m.MBIDReleaseGroup, &tagsJSON)
 		if err != nil {
 			return nil, err
 		}
+		if tagsJSON != "" {
+			json.Unmarshal([]byte(tagsJSON), &m.Tags)
+		}
+		ids = append(ids, id)
 		results = append(results, m)
 	}
+
+	for i, id := range ids {
+		genres, err := s.genresForItem(id)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Genres = genres
+	}
 	return results, nil
 }
+
+func (s *SQLiteStore) genresForItem(itemID int64) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT tag.value FROM tag
+		JOIN item_tags ON item_tags.tag_id = tag.id
+		WHERE item_tags.item_id = ? AND item_tags.tag_name = 'genre'
+		ORDER BY tag.value`, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var genres []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		genres = append(genres, v)
+	}
+	return genres, nil
+}
@@ -0,0 +1,102 @@
+//go:build cgo
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// synthesizeLibrary populates store with n media entries spread across a
+// small set of artists/albums/titles, so both the LIKE path and the FTS5
+// path have realistic (if repetitive) text to search through.
+func synthesizeLibrary(b *testing.B, store *SQLiteStore, n int) {
+	b.Helper()
+
+	artists := []string{"The Rolling Stones", "Fleetwood Mac", "Daft Punk", "Radiohead", "Billie Eilish"}
+	albums := []string{"Sticky Fingers", "Rumours", "Discovery", "OK Computer", "Happier Than Ever"}
+
+	const batchSize = 1000
+	batch := make([]*Media, 0, batchSize)
+	for i := 0; i < n; i++ {
+		m := &Media{
+			Title:  fmt.Sprintf("Track %d", i),
+			Artist: artists[i%len(artists)],
+			Album:  albums[i%len(albums)],
+			Path:   fmt.Sprintf("/lib/%d.mp3", i),
+		}
+		m.OrderArtistName = NormalizeOrderName(m.Artist)
+		m.OrderAlbumName = NormalizeOrderName(m.Album)
+		batch = append(batch, m)
+		if len(batch) == batchSize {
+			if err := store.IndexMediaBatch(batch, 0); err != nil {
+				b.Fatalf("IndexMediaBatch: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := store.IndexMediaBatch(batch, 0); err != nil {
+			b.Fatalf("IndexMediaBatch: %v", err)
+		}
+	}
+}
+
+// newBenchStore opens a fresh on-disk SQLiteStore in b's temp dir, since
+// the FTS5 triggers need a real rowid-backed table, not :memory:'s
+// per-connection semantics under database/sql's connection pooling.
+func newBenchStore(b *testing.B) *SQLiteStore {
+	b.Helper()
+	store := &SQLiteStore{}
+	path := filepath.Join(b.TempDir(), "bench.sqlite")
+	if err := store.Initialize(path); err != nil {
+		b.Fatalf("Initialize: %v", err)
+	}
+	b.Cleanup(func() { store.Close() })
+	return store
+}
+
+// BenchmarkSearchLike measures the pre-FTS5 approach: a LIKE scan across
+// artist/album/title for a free-text query, to compare against
+// BenchmarkSearchFTS on the same synthesized 100k-entry library.
+func BenchmarkSearchLike(b *testing.B) {
+	store := newBenchStore(b)
+	synthesizeLibrary(b, store, 100000)
+
+	const needle = "%Fleetwood%"
+	query := `SELECT id FROM media WHERE artist LIKE ? OR album LIKE ? OR title LIKE ?`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rows, err := store.db.Query(query, needle, needle, needle)
+		if err != nil {
+			b.Fatalf("query: %v", err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+	}
+}
+
+// BenchmarkSearchFTS measures the FTS5 MATCH path added by migration 5
+// (see ftsMatchQuery), on the same synthesized 100k-entry library as
+// BenchmarkSearchLike.
+func BenchmarkSearchFTS(b *testing.B) {
+	store := newBenchStore(b)
+	synthesizeLibrary(b, store, 100000)
+
+	query := `SELECT media.id FROM media WHERE media.id IN (SELECT rowid FROM media_fts WHERE media_fts MATCH ?)`
+	matchQuery := ftsMatchQuery("fleetwood")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rows, err := store.db.Query(query, matchQuery)
+		if err != nil {
+			b.Fatalf("query: %v", err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+	}
+}
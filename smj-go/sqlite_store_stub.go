@@ -2,7 +2,10 @@
 
 package main
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type SQLiteStore struct{}
 
@@ -14,12 +17,38 @@ func (s *SQLiteStore) Close() error { return nil }
 
 func (s *SQLiteStore) Clear() error { return nil }
 
-func (s *SQLiteStore) IndexMediaBatch(batch []*Media) error { return nil }
+func (s *SQLiteStore) AddLibrary(name, path string) (int64, error) { return 0, nil }
+
+func (s *SQLiteStore) RemoveLibrary(id int64) error { return nil }
+
+func (s *SQLiteStore) ListLibraries() ([]Library, error) { return nil, nil }
+
+func (s *SQLiteStore) UpdateLastScan(libraryID int64, at time.Time) error { return nil }
+
+func (s *SQLiteStore) IndexMediaBatch(batch []*Media, libraryID int64) error { return nil }
 
 func (s *SQLiteStore) Count() (int, error) { return 0, nil }
 
-func (s *SQLiteStore) GetAllPaths() ([]string, error) { return nil, nil }
+func (s *SQLiteStore) GetAllPaths(libraryID int64) ([]string, error) { return nil, nil }
+
+func (s *SQLiteStore) PathIndexed(path string) (bool, error) { return false, nil }
+
+func (s *SQLiteStore) RemoveStaleEntries(libraryID int64) (int, error) { return 0, nil }
+
+func (s *SQLiteStore) Search(opts QueryOptions) ([]Media, error) { return nil, nil }
+
+func (s *SQLiteStore) Tags(name string) ([]TagCount, error) { return nil, nil }
+
+func (s *SQLiteStore) AddUser(username, password string) error { return nil }
+
+func (s *SQLiteStore) UserPassword(username string) (string, bool, error) { return "", false, nil }
+
+func (s *SQLiteStore) GetSetting(key string) (string, bool, error) { return "", false, nil }
+
+func (s *SQLiteStore) SetSetting(key, value string) error { return nil }
+
+func (s *SQLiteStore) QueuePendingListen(l PendingListen) error { return nil }
 
-func (s *SQLiteStore) RemoveStaleEntries() (int, error) { return 0, nil }
+func (s *SQLiteStore) PendingListens() ([]PendingListen, error) { return nil, nil }
 
-func (s *SQLiteStore) Search(input string) ([]Media, error) { return nil, nil }
+func (s *SQLiteStore) RemovePendingListen(id int64) error { return nil }
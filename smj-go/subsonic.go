@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// subsonicAPIVersion is the Subsonic/OpenSubsonic protocol version smj-go
+// claims support for. Clients use this to gate which optional fields they
+// expect back.
+const subsonicAPIVersion = "1.16.1"
+
+// subsonicServer adapts a Datastore to the Subsonic API so mobile clients
+// (DSub, Symfonium, Jamstash, ...) can browse and stream from a smj-go
+// library without smj-go growing its own client. Only JSON responses
+// (f=json) are produced; smj-go is JSON-first elsewhere (see --json), and
+// full XML marshaling of the Subsonic schema isn't worth the surface for
+// clients that already support f=json.
+type subsonicServer struct {
+	store Datastore
+}
+
+// serveSubsonic starts the Subsonic HTTP API on addr, serving from store
+// until the process exits.
+func serveSubsonic(store Datastore, addr string) error {
+	s := &subsonicServer{store: store}
+	mux := http.NewServeMux()
+
+	register := func(name string, h http.HandlerFunc) {
+		mux.HandleFunc("/rest/"+name, s.authenticated(h))
+		mux.HandleFunc("/rest/"+name+".view", s.authenticated(h))
+	}
+	register("ping", s.handlePing)
+	register("getArtists", s.handleGetArtists)
+	register("getAlbumList2", s.handleGetAlbumList2)
+	register("search3", s.handleSearch3)
+	register("stream", s.handleStream)
+	register("download", s.handleStream)
+	register("getCoverArt", s.handleGetCoverArt)
+
+	// /intent isn't a Subsonic REST method, so it's registered directly
+	// rather than through register()'s "/rest/<name>[.view]" convention;
+	// see handleIntent.
+	mux.HandleFunc("/intent", s.authenticated(s.handleIntent))
+
+	log.Printf("Subsonic API listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// authenticated wraps next with Subsonic's token+salt auth scheme: the
+// client sends username u, salt s, and t = hex(md5(password + s)).
+func (s *subsonicServer) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeSubsonicError(w, 0, "missing parameters")
+			return
+		}
+
+		username := r.Form.Get("u")
+		token := r.Form.Get("t")
+		salt := r.Form.Get("s")
+		if username == "" || token == "" || salt == "" {
+			writeSubsonicError(w, 10, "required parameter is missing")
+			return
+		}
+
+		encrypted, ok, err := s.store.UserPassword(username)
+		if err != nil || !ok {
+			writeSubsonicError(w, 40, "wrong username or password")
+			return
+		}
+		password, err := decryptUserPassword(s.store, encrypted)
+		if err != nil {
+			writeSubsonicError(w, 40, "wrong username or password")
+			return
+		}
+		sum := md5.Sum([]byte(password + salt))
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), token) {
+			writeSubsonicError(w, 40, "wrong username or password")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeSubsonicJSON(w http.ResponseWriter, payload map[string]interface{}) {
+	payload["status"] = "ok"
+	payload["version"] = subsonicAPIVersion
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": payload})
+}
+
+func writeSubsonicError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subsonic-response": map[string]interface{}{
+			"status":  "failed",
+			"version": subsonicAPIVersion,
+			"error":   map[string]interface{}{"code": code, "message": message},
+		},
+	})
+}
+
+func (s *subsonicServer) handlePing(w http.ResponseWriter, r *http.Request) {
+	writeSubsonicJSON(w, map[string]interface{}{})
+}
+
+// subsonicSecretKeySetting is the Datastore.GetSetting key under which the
+// server's password-encryption key (see subsonicSecretKey) is stored.
+const subsonicSecretKeySetting = "subsonic_secret_key"
+
+// subsonicSecretKey returns the server's AES-256 key for encrypting
+// stored Subsonic passwords at rest, generating and persisting one via
+// store.SetSetting the first time it's needed, so it survives restarts.
+func subsonicSecretKey(store Datastore) ([]byte, error) {
+	hexKey, ok, err := store.GetSetting(subsonicSecretKeySetting)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return hex.DecodeString(hexKey)
+	}
+
+	key := make([]byte, 32)
+	if _, err := cryptorand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := store.SetSetting(subsonicSecretKeySetting, hex.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encryptUserPassword encrypts plaintext with the server's secret key (see
+// subsonicSecretKey), so AddUser never writes a user's real password to
+// the datastore in the clear. decryptUserPassword reverses it for the
+// token+salt check in authenticated, which needs the plaintext back to
+// compute md5(password+salt).
+func encryptUserPassword(store Datastore, plaintext string) (string, error) {
+	gcm, err := subsonicGCM(store)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return "", err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return hex.EncodeToString(ciphertext), nil
+}
+
+// decryptUserPassword reverses encryptUserPassword.
+func decryptUserPassword(store Datastore, ciphertext string) (string, error) {
+	gcm, err := subsonicGCM(store)
+	if err != nil {
+		return "", err
+	}
+	raw, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", fmt.Errorf("subsonic: malformed encrypted password")
+	}
+	nonce, sealed := raw[:gcm.NonceSize()], raw[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// subsonicGCM builds the AES-GCM cipher used by encrypt/decryptUserPassword.
+func subsonicGCM(store Datastore) (cipher.AEAD, error) {
+	key, err := subsonicSecretKey(store)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// songID/pathFromSongID turn a file path into an opaque Subsonic song id
+// and back; stream/download/getCoverArt only ever need to resolve an id
+// back to the path it came from.
+func songID(path string) string {
+	return hex.EncodeToString([]byte(path))
+}
+
+func pathFromSongID(id string) (string, bool) {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// handleGetArtists groups the whole catalog by artist, the way jsonizer
+// groups by artist/album for --json output. Grouping is keyed by
+// artistGroupKey (MBID when tags provide one) rather than the raw artist
+// name, so two distinct artists sharing a display name don't collapse.
+func (s *subsonicServer) handleGetArtists(w http.ResponseWriter, r *http.Request) {
+	results, err := s.store.Search(QueryOptions{Sort: "artist"})
+	if err != nil {
+		writeSubsonicError(w, 0, err.Error())
+		return
+	}
+
+	type artist struct {
+		name   string
+		albums map[string]bool
+	}
+	artistsByKey := make(map[string]*artist)
+	var keys []string
+	for _, m := range results {
+		key := artistGroupKey(m)
+		a, ok := artistsByKey[key]
+		if !ok {
+			a = &artist{name: m.Artist, albums: make(map[string]bool)}
+			artistsByKey[key] = a
+			keys = append(keys, key)
+		}
+		a.albums[albumGroupKey(m)] = true
+	}
+	sort.Slice(keys, func(i, j int) bool { return artistsByKey[keys[i]].name < artistsByKey[keys[j]].name })
+
+	var entries []map[string]interface{}
+	for _, key := range keys {
+		a := artistsByKey[key]
+		entries = append(entries, map[string]interface{}{
+			"id":         songID(key),
+			"name":       a.name,
+			"albumCount": len(a.albums),
+		})
+	}
+
+	writeSubsonicJSON(w, map[string]interface{}{
+		"artists": map[string]interface{}{
+			"index": []map[string]interface{}{{"name": "*", "artist": entries}},
+		},
+	})
+}
+
+// handleGetAlbumList2 lists distinct albums across the catalog, ordered by
+// artist, or most recently added first for type=newest. Subsonic's
+// size/offset paging is applied to the grouped albums in memory, after
+// fetching every matching song.
+func (s *subsonicServer) handleGetAlbumList2(w http.ResponseWriter, r *http.Request) {
+	sortField, sortOrder := "artist", ""
+	if r.Form.Get("type") == "newest" {
+		sortField, sortOrder = "recently_added", "desc"
+	}
+
+	size, _ := strconv.Atoi(r.Form.Get("size"))
+	if size <= 0 {
+		size = 10
+	}
+	offset, _ := strconv.Atoi(r.Form.Get("offset"))
+
+	results, err := s.store.Search(QueryOptions{Sort: sortField, Order: sortOrder})
+	if err != nil {
+		writeSubsonicError(w, 0, err.Error())
+		return
+	}
+
+	type album struct {
+		key, artist, name string
+		songCount         int
+	}
+	var albums []album
+	seen := make(map[string]int)
+	for _, m := range results {
+		key := albumGroupKey(m)
+		if i, ok := seen[key]; ok {
+			albums[i].songCount++
+			continue
+		}
+		seen[key] = len(albums)
+		albums = append(albums, album{key: key, artist: m.Artist, name: m.Album, songCount: 1})
+	}
+
+	if offset > len(albums) {
+		offset = len(albums)
+	}
+	end := offset + size
+	if end > len(albums) {
+		end = len(albums)
+	}
+
+	var entries []map[string]interface{}
+	for _, a := range albums[offset:end] {
+		entries = append(entries, map[string]interface{}{
+			"id":        songID(a.key),
+			"name":      a.name,
+			"artist":    a.artist,
+			"songCount": a.songCount,
+		})
+	}
+
+	writeSubsonicJSON(w, map[string]interface{}{
+		"albumList2": map[string]interface{}{"album": entries},
+	})
+}
+
+// handleSearch3 maps Subsonic's free-text "query" onto SearchString's
+// SMJ7-or-fallback search, same as the CLI's -q flag.
+func (s *subsonicServer) handleSearch3(w http.ResponseWriter, r *http.Request) {
+	results, err := SearchString(s.store, r.Form.Get("query"))
+	if err != nil {
+		writeSubsonicError(w, 0, err.Error())
+		return
+	}
+
+	var songs []map[string]interface{}
+	for _, m := range results {
+		songs = append(songs, subsonicSong(m))
+	}
+
+	writeSubsonicJSON(w, map[string]interface{}{
+		"searchResult3": map[string]interface{}{"song": songs},
+	})
+}
+
+func subsonicSong(m Media) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         songID(m.Path),
+		"title":      m.Title,
+		"artist":     m.Artist,
+		"album":      m.Album,
+		"track":      m.TrackNumber,
+		"discNumber": m.DiscNumber,
+		"genre":      strings.Join(m.Genres, ", "),
+		"isDir":      false,
+		"coverArt":   songID(m.Path),
+	}
+}
+
+// handleStream serves the raw audio file for a song id, honoring Range
+// requests so clients can seek/resume.
+func (s *subsonicServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	path, ok := pathFromSongID(r.Form.Get("id"))
+	if !ok {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+	if indexed, err := s.store.PathIndexed(path); err != nil || !indexed {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// handleGetCoverArt extracts embedded cover art from a song's tags, since
+// smj-go doesn't store art files separately on disk.
+func (s *subsonicServer) handleGetCoverArt(w http.ResponseWriter, r *http.Request) {
+	path, ok := pathFromSongID(r.Form.Get("id"))
+	if !ok {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+	if indexed, err := s.store.PathIndexed(path); err != nil || !indexed {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+	defer f.Close()
+
+	m, err := tag.ReadFrom(f)
+	if err != nil || m.Picture() == nil {
+		writeSubsonicError(w, 70, "the requested data was not found")
+		return
+	}
+
+	pic := m.Picture()
+	w.Header().Set("Content-Type", pic.MIMEType)
+	w.Write(pic.Data)
+}
+
+// intentRequest is the JSON body POST /intent expects: a voice-assistant
+// intent name (as sent by an Alexa skill or Home Assistant media_player)
+// plus whatever slots that intent carries.
+type intentRequest struct {
+	Intent string            `json:"intent"`
+	Slots  map[string]string `json:"slots"`
+}
+
+// queryForIntent maps a voice intent onto the SMJ7 query string passed to
+// SearchString, using only "!@#$^%"-prefixed/free-text SMJ7 syntax (see
+// sqlbuilder.go's parseSMJ7 and bleve_store.go's smj7Query). BleveStore
+// only routes a query through smj7Query when it holds a prefix character
+// or a comma; a lone unprefixed term (e.g. StartPlay's bare ArtistName)
+// goes to Bleve's query-string syntax instead. StartPlayAlbumOrTitle pairs
+// an "@artist" selector with an unprefixed AlbumOrTitle term: unprefixed
+// terms already match against title, artist, and album alike (FTS5 MATCH
+// on SQLite, tsquery on Postgres, a title/artist/album OR-query on Bleve),
+// giving the same "match either field" behavior the slot is meant to express.
+// ResumePlay and Next have no "now playing" state to act on since this
+// server is stateless between requests, so they resolve the same way
+// StartPlay does.
+func queryForIntent(intent string, slots map[string]string) (query string, shuffle bool) {
+	artist := slots["ArtistName"]
+	albumOrTitle := slots["AlbumOrTitle"]
+
+	switch intent {
+	case "StartPlayAlbumOrTitle":
+		var parts []string
+		if artist != "" {
+			parts = append(parts, "@"+artist)
+		}
+		if albumOrTitle != "" {
+			parts = append(parts, albumOrTitle)
+		}
+		return strings.Join(parts, ","), false
+	case "Shuffle":
+		return artist, true
+	case "StartPlay", "ResumePlay", "Next":
+		return artist, false
+	default:
+		return "", false
+	}
+}
+
+// handleIntent implements POST /intent, a minimal voice-control surface
+// for an Alexa skill or Home Assistant's media_player: it maps one of
+// StartPlay, StartPlayAlbumOrTitle, ResumePlay, Shuffle, or Next onto a
+// search and returns a resolved playlist of stream URLs the skill can
+// enqueue directly.
+func (s *subsonicServer) handleIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeSubsonicError(w, 0, "POST required")
+		return
+	}
+
+	var req intentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSubsonicError(w, 0, "malformed intent body")
+		return
+	}
+
+	query, shuffle := queryForIntent(req.Intent, req.Slots)
+	results, err := SearchString(s.store, query)
+	if err != nil {
+		writeSubsonicError(w, 0, err.Error())
+		return
+	}
+	if shuffle {
+		rand.Shuffle(len(results), func(i, j int) { results[i], results[j] = results[j], results[i] })
+	}
+
+	// Forward this request's own auth so the returned URLs work without
+	// the skill having to separately know the token+salt scheme.
+	auth := url.Values{"u": {r.Form.Get("u")}, "t": {r.Form.Get("t")}, "s": {r.Form.Get("s")}}.Encode()
+
+	var playlist []map[string]interface{}
+	for _, m := range results {
+		playlist = append(playlist, map[string]interface{}{
+			"title":  m.Title,
+			"artist": m.Artist,
+			"album":  m.Album,
+			"url":    "/rest/stream.view?id=" + songID(m.Path) + "&" + auth,
+		})
+	}
+
+	writeSubsonicJSON(w, map[string]interface{}{
+		"intent":   req.Intent,
+		"playlist": playlist,
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import "github.com/dhowden/tag"
+
+// extraTagKeys maps a normalized tag name to the raw frame/field keys
+// dhowden/tag exposes it under via Raw(), for metadata that has no typed
+// accessor on tag.Metadata (see rawTagString). Tags with a typed accessor
+// (composer, comment) are read directly in extractExtraTags instead.
+var extraTagKeys = map[string][]string{
+	"conductor":     {"TPE3", "CONDUCTOR"},
+	"mood":          {"TMOO", "MOOD"},
+	"bpm":           {"TBPM", "BPM"},
+	"compilation":   {"TCMP", "COMPILATION"},
+	"disc_subtitle": {"TSST", "DISCSUBTITLE"},
+}
+
+// extractExtraTags reads the "rich" tags beyond the fixed title/artist/
+// album/genre columns, keyed by normalized tag name with one or more
+// values: composer and comment via dhowden/tag's typed accessors, and
+// conductor/mood/bpm/compilation/disc subtitle from raw frames via
+// extraTagKeys. Returns nil when the file carries none of them, so callers
+// can tell "no rich tags" apart from "empty map" without an extra check.
+func extractExtraTags(m tag.Metadata) map[string][]string {
+	tags := make(map[string][]string)
+
+	add := func(name, value string) {
+		if value != "" {
+			tags[name] = append(tags[name], value)
+		}
+	}
+
+	add("composer", m.Composer())
+	add("comment", m.Comment())
+	for name, keys := range extraTagKeys {
+		add(name, rawTagString(m, keys...))
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}